@@ -0,0 +1,566 @@
+package main
+
+// This file implements tracking compile actions for the stats page. Events are
+// queued and written to the configured analytics sink in the background, so
+// that a slow sink doesn't slow down compiles.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by analytics sinks that can't be queried, like the disabled sink.
+var errStatsUnavailable = errors.New("stats are not available")
+
+const (
+	analyticsQueueSize     = 1000            // events buffered before they are dropped
+	analyticsBatchSize     = 100             // maximum number of events written at once
+	analyticsFlushInterval = 5 * time.Second // maximum time an event is buffered
+	analyticsWriteTimeout  = 30 * time.Second
+)
+
+// Upper bounds of the duration buckets in tracked compile events. Durations
+// are tracked as buckets so that they can be aggregated like other counters.
+var telemetryBuckets = []time.Duration{
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	60 * time.Second,
+}
+
+// Substrings in compiler output, used to classify compile errors. The first
+// match wins. The Go compiler reports syntax errors as "syntax error: ...",
+// but TinyGo parses with go/parser, which reports them as "file:line:col:
+// expected ..., found ...". The colon before "expected" keeps those patterns
+// from matching anywhere else, like in quoted code.
+var compileErrorClasses = []struct {
+	class    string
+	patterns []string
+}{
+	{"syntax", []string{"syntax error", ": expected '", ": expected declaration", ": expected operand", ": expected statement", ": expected expression", ": expected type", ": missing ','", "literal not terminated"}},
+	{"import", []string{"could not import", "cannot find package", "is not in std", "no required module provides package", "imported and not used"}},
+	{"undefined", []string{"undefined:", " undefined (type "}},
+	{"unused", []string{"declared and not used", "declared but not used"}},
+	{"type", []string{"cannot use", "mismatched types", "invalid operation", "not enough arguments", "too many arguments", "cannot convert"}},
+	{"link", []string{"undefined symbol", "ld.lld", "wasm-ld", "linker"}},
+}
+
+// compileEvent is a single compile action, as tracked by trackCompile.
+type compileEvent struct {
+	Time             time.Time `json:"time"`
+	Page             string    `json:"page"`
+	Compiler         string    `json:"compiler"`
+	Target           string    `json:"target"`
+	FlashFirmware    bool      `json:"flashFirmware"`
+	Modified         bool      `json:"modified"`         // whether the user modified the code
+	Outcome          string    `json:"outcome"`          // success, compile-error, timeout, cancelled or error
+	QueueBucket      string    `json:"queueBucket"`      // time spent in the compile queue, see durationBucket
+	BuildBucket      string    `json:"buildBucket"`      // time spent compiling, see durationBucket
+	CacheTier        string    `json:"cacheTier"`        // client (not modified), local, gcs, elf (derived from a cached ELF) or build (not cached)
+	ToolchainVersion string    `json:"toolchainVersion"` // version of the compiler, like go1.22.0 or 0.39.0
+	ErrorClass       string    `json:"errorClass"`       // kind of compile error, see classifyCompileError
+}
+
+// compileStats is filled in by a compile job, to be tracked in a
+// compileEvent.
+type compileStats struct {
+	QueueWait     time.Duration
+	BuildDuration time.Duration
+	CacheTier     string
+	Outcome       string
+	ErrorClass    string
+}
+
+// apply copies the stats to the event.
+func (stats *compileStats) apply(event *compileEvent) {
+	event.Outcome = stats.Outcome
+	event.QueueBucket = durationBucket(stats.QueueWait)
+	event.CacheTier = stats.CacheTier
+	event.ErrorClass = stats.ErrorClass
+	if stats.CacheTier == "build" {
+		event.BuildBucket = durationBucket(stats.BuildDuration)
+	}
+}
+
+// durationBucket returns the bucket of telemetryBuckets the duration falls in,
+// like "1s-2s".
+func durationBucket(d time.Duration) string {
+	lower := time.Duration(0)
+	for _, upper := range telemetryBuckets {
+		if d < upper {
+			return lower.String() + "-" + upper.String()
+		}
+		lower = upper
+	}
+	return ">" + lower.String()
+}
+
+// classifyCompileError returns a coarse category for a compile error, based
+// on the compiler output.
+func classifyCompileError(output []byte) string {
+	for _, class := range compileErrorClasses {
+		for _, pattern := range class.patterns {
+			if bytes.Contains(output, []byte(pattern)) {
+				return class.class
+			}
+		}
+	}
+	return "other"
+}
+
+var toolchainVersions = struct {
+	lock     sync.Mutex
+	versions map[string]string
+}{
+	versions: make(map[string]string),
+}
+
+// toolchainVersion returns the version of the given compiler ("go" or
+// "tinygo"), or "unknown" if it can't be determined. The version is only
+// looked up once.
+func toolchainVersion(compiler string) string {
+	toolchainVersions.lock.Lock()
+	defer toolchainVersions.lock.Unlock()
+	if version, ok := toolchainVersions.versions[compiler]; ok {
+		return version
+	}
+	version := "unknown"
+	// The output looks like "go version go1.22.0 linux/amd64" or "tinygo
+	// version 0.39.0 linux/amd64 (using ...)".
+	out, err := exec.Command(compiler, "version").Output()
+	if fields := strings.Fields(string(out)); err == nil && len(fields) >= 3 {
+		version = fields[2]
+	}
+	toolchainVersions.versions[compiler] = version
+	return version
+}
+
+// trackPoint returns the event as a trackPoint with a count of one.
+func (e *compileEvent) trackPoint() trackPoint {
+	point := trackPoint{
+		Day:           e.Time.UTC().Truncate(24 * time.Hour),
+		Page:          e.Page,
+		Compiler:      e.Compiler,
+		Target:        e.Target,
+		FlashFirmware: e.FlashFirmware,
+
+		Outcome:          e.Outcome,
+		QueueBucket:      e.QueueBucket,
+		BuildBucket:      e.BuildBucket,
+		CacheTier:        e.CacheTier,
+		ToolchainVersion: e.ToolchainVersion,
+		ErrorClass:       e.ErrorClass,
+	}
+	if e.Modified {
+		point.Modified = 1
+	} else {
+		point.Initial = 1
+	}
+	return point
+}
+
+// analyticsSink stores compile events.
+type analyticsSink interface {
+	// Write stores a batch of events.
+	Write(ctx context.Context, events []compileEvent) error
+
+	// Query returns the stored events from the given day up to (but not
+	// including) the given day, summed per day where possible. It returns
+	// errStatsUnavailable if the sink can't be queried.
+	Query(ctx context.Context, from, to time.Time) ([]trackPoint, error)
+
+	// Close flushes and closes the sink.
+	Close() error
+}
+
+// openAnalyticsSink opens the analytics sink of the given type ("disabled",
+// "firestore", "jsonl" or "memory").
+func openAnalyticsSink(sink, path string) (analyticsSink, error) {
+	switch sink {
+	case "disabled":
+		return disabledAnalytics{}, nil
+	case "firestore":
+		return firestoreAnalytics{}, nil
+	case "jsonl":
+		return newJSONLAnalytics(path, conf.AnalyticsMaxSize, conf.AnalyticsMaxFiles)
+	case "memory":
+		return &memoryAnalytics{}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized analytics sink: %s", sink)
+	}
+}
+
+// analyticsQueue writes events to a sink in the background, in batches.
+type analyticsQueue struct {
+	sink   analyticsSink
+	events chan compileEvent // never closed, as Add may be called at any time
+	stop   chan struct{}     // closed by Close
+	done   chan struct{}     // closed when all events are written
+
+	lock   sync.Mutex
+	closed bool
+}
+
+// The analytics queue configured for this server.
+var analytics *analyticsQueue
+
+func newAnalyticsQueue(sink analyticsSink) *analyticsQueue {
+	q := &analyticsQueue{
+		sink:   sink,
+		events: make(chan compileEvent, analyticsQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Add queues an event. It never blocks: if the queue is full or closed, the
+// event is dropped.
+func (q *analyticsQueue) Add(event compileEvent) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		metricAnalyticsEvents.Inc("dropped")
+		return
+	}
+	select {
+	case q.events <- event:
+	default:
+		metricAnalyticsEvents.Inc("dropped")
+	}
+}
+
+// Close writes all queued events and closes the sink. Events added after
+// Close are dropped.
+func (q *analyticsQueue) Close() error {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.lock.Unlock()
+	close(q.stop)
+	<-q.done
+	return q.sink.Close()
+}
+
+func (q *analyticsQueue) run() {
+	defer close(q.done)
+	ticker := time.NewTicker(analyticsFlushInterval)
+	defer ticker.Stop()
+	var batch []compileEvent
+	for {
+		select {
+		case event := <-q.events:
+			batch = append(batch, event)
+			if len(batch) < analyticsBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-q.stop:
+			// No events are added anymore, so write what is left.
+			for {
+				select {
+				case event := <-q.events:
+					batch = append(batch, event)
+				default:
+					q.write(batch)
+					return
+				}
+			}
+		}
+		q.write(batch)
+		batch = nil
+	}
+}
+
+func (q *analyticsQueue) write(batch []compileEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	// Looking up the version can be slow the first time, so do it here
+	// instead of while handling the request.
+	for i := range batch {
+		batch[i].ToolchainVersion = toolchainVersion(batch[i].Compiler)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), analyticsWriteTimeout)
+	defer cancel()
+	if err := q.sink.Write(ctx, batch); err != nil {
+		metricAnalyticsEvents.Add(float64(len(batch)), "error")
+		slog.Error("could not store tracking data", "events", len(batch), "err", err)
+		return
+	}
+	metricAnalyticsEvents.Add(float64(len(batch)), "written")
+}
+
+// Track a single compiler action. The modified parameter is the value of the
+// TinyGo-Modified header: "true" or "false". Other values aren't tracked.
+func trackCompile(event compileEvent, modified string) {
+	switch modified {
+	case "false":
+		event.Modified = false
+	case "true":
+		event.Modified = true
+	default:
+		// No valid "modified" parameter given, so can't track.
+		return
+	}
+	analytics.Add(event)
+}
+
+// disabledAnalytics drops all events.
+type disabledAnalytics struct{}
+
+func (disabledAnalytics) Write(ctx context.Context, events []compileEvent) error {
+	return nil
+}
+
+func (disabledAnalytics) Query(ctx context.Context, from, to time.Time) ([]trackPoint, error) {
+	return nil, errStatsUnavailable
+}
+
+func (disabledAnalytics) Close() error {
+	return nil
+}
+
+// memoryAnalytics keeps all events in memory. It is only useful for testing.
+type memoryAnalytics struct {
+	lock   sync.Mutex
+	events []compileEvent
+}
+
+func (m *memoryAnalytics) Write(ctx context.Context, events []compileEvent) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.events = append(m.events, events...)
+	return nil
+}
+
+func (m *memoryAnalytics) Query(ctx context.Context, from, to time.Time) ([]trackPoint, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var points []trackPoint
+	for _, event := range m.events {
+		if !event.Time.Before(from) && event.Time.Before(to) {
+			points = append(points, event.trackPoint())
+		}
+	}
+	return points, nil
+}
+
+func (m *memoryAnalytics) Close() error {
+	return nil
+}
+
+// jsonlAnalytics appends events as JSON lines to a file. When the file grows
+// beyond maxSize it is renamed with a timestamp suffix and a new file is
+// started, keeping at most maxFiles old files.
+type jsonlAnalytics struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newJSONLAnalytics(path string, maxSize int64, maxFiles int) (*jsonlAnalytics, error) {
+	if path == "" {
+		return nil, errors.New("no analytics path configured for the jsonl analytics sink")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return nil, err
+	}
+	a := &jsonlAnalytics{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// open opens the current file for appending.
+func (a *jsonlAnalytics) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = st.Size()
+	return nil
+}
+
+func (a *jsonlAnalytics) Write(ctx context.Context, events []compileEvent) error {
+	var buf []byte
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.maxSize > 0 && a.size != 0 && a.size+int64(len(buf)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(buf)
+	a.size += int64(n)
+	return err
+}
+
+// rotate moves the current file aside and starts a new one.
+func (a *jsonlAnalytics) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	// Rename would silently replace a file rotated at the same time, so move
+	// the timestamp forward until the name is free. The names still sort
+	// chronologically, also next to the millisecond names used before.
+	ext := filepath.Ext(a.path)
+	now := time.Now().UTC()
+	var rotated string
+	for {
+		rotated = strings.TrimSuffix(a.path, ext) + "-" + now.Format("20060102T150405.000000000") + ext
+		if _, err := os.Lstat(rotated); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		now = now.Add(time.Nanosecond)
+	}
+	if err := os.Rename(a.path, rotated); err != nil {
+		return err
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	// Remove the oldest files.
+	files, err := a.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	if a.maxFiles > 0 && len(files) > a.maxFiles {
+		for _, path := range files[:len(files)-a.maxFiles] {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// rotatedFiles returns the rotated files, oldest first.
+func (a *jsonlAnalytics) rotatedFiles() ([]string, error) {
+	ext := filepath.Ext(a.path)
+	files, err := filepath.Glob(strings.TrimSuffix(a.path, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files) // the timestamps sort chronologically
+	return files, nil
+}
+
+func (a *jsonlAnalytics) Query(ctx context.Context, from, to time.Time) ([]trackPoint, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	files, err := a.rotatedFiles()
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, a.path)
+
+	// Sum the events per day and group, to keep the result small.
+	counts := make(map[trackPoint]*trackPoint)
+	for _, path := range files {
+		err := readJSONL(path, func(event *compileEvent) {
+			if event.Time.Before(from) || !event.Time.Before(to) {
+				return
+			}
+			point := event.trackPoint()
+			key := point
+			key.Initial, key.Modified = 0, 0
+			sum := counts[key]
+			if sum == nil {
+				sum = &trackPoint{}
+				*sum = key
+				counts[key] = sum
+			}
+			sum.Initial += point.Initial
+			sum.Modified += point.Modified
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	points := make([]trackPoint, 0, len(counts))
+	for _, point := range counts {
+		points = append(points, *point)
+	}
+	return points, nil
+}
+
+// readJSONL calls fn for every event in the given file. Lines that can't be
+// parsed (for example, a line that was only partially written) are skipped.
+func readJSONL(path string, fn func(*compileEvent)) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // removed during rotation
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) != 0 {
+			var event compileEvent
+			if json.Unmarshal(line, &event) == nil {
+				fn(&event)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (a *jsonlAnalytics) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.file.Close()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClassifyCompileError(t *testing.T) {
+	// Output of "go build" (Go 1.22 and later) and of go/parser and go/types,
+	// which TinyGo reports its errors with.
+	for _, tc := range []struct {
+		output string
+		class  string
+	}{
+		// go build
+		{"# x\n./main.go:2:25: syntax error: unexpected }, expected expression", "syntax"},
+		{"# x\n./main.go:5:1: syntax error: unexpected EOF, expected }", "syntax"},
+		{"# x\n./main.go:2:1: syntax error: non-declaration statement outside function body", "syntax"},
+		{"# x\n./main.go:2:27: cannot use \"expected \" (untyped string constant) as int value in variable declaration", "type"},
+		{"# x\n./main.go:2:29: cannot use map[string]int{} (value of type map[string]int) as []int value in variable declaration\n./main.go:2:69: invalid operation: b[1:2] + 1 (mismatched types string and untyped int)", "type"},
+		{"# x\n./main.go:2:36: not enough arguments in call to f\n\thave ()\n\twant (int)", "type"},
+		{"# x\n./main.go:2:15: undefined: undefinedThing", "undefined"},
+		{"# x\n./main.go:2:33: s.Expected undefined (type struct{} has no field or method Expected)", "undefined"},
+		{"# x\n./main.go:2:8: \"os\" imported and not used", "import"},
+		{"# x\n./main.go:2:15: declared and not used: x", "unused"},
+
+		// go/parser and go/types (TinyGo)
+		{"main.go:2:25: expected operand, found '}'", "syntax"},
+		{"main.go:4:2: expected ';', found 'EOF'", "syntax"},
+		{"main.go:2:9: expected ')', found '{'", "syntax"},
+		{"main.go:3:31: missing ',' in argument list", "syntax"},
+		{"main.go:2:1: expected declaration, found x", "syntax"},
+		{"main.go:2:20: string literal not terminated", "syntax"},
+		{"main.go:2:27: cannot use \"expected \" (untyped string constant) as int value in variable declaration", "type"},
+		{"main.go:2:15: undefined: undefinedThing", "undefined"},
+		{"main.go:2:8: \"os\" imported and not used", "import"},
+		{"main.go:2:15: declared and not used: x", "unused"},
+
+		{"panic: runtime error: index out of range [5] with length 3", "other"},
+		{"", "other"},
+	} {
+		if class := classifyCompileError([]byte(tc.output)); class != tc.class {
+			t.Errorf("classified as %q, expected %q:\n%s", class, tc.class, tc.output)
+		}
+	}
+}
+
+func TestAnalyticsQueueClose(t *testing.T) {
+	sink := &memoryAnalytics{}
+	q := newAnalyticsQueue(sink)
+	for i := 0; i < 10; i++ {
+		q.Add(compileEvent{Time: time.Now(), Target: "wasm"})
+	}
+
+	// Handlers may still be tracking compiles while the server shuts down.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					q.Add(compileEvent{Time: time.Now(), Target: "arduino"})
+				}
+			}
+		}()
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+	q.Add(compileEvent{Time: time.Now(), Target: "wasm"})
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	written := 0
+	for _, event := range sink.events {
+		if event.Target == "wasm" {
+			written++
+		}
+	}
+	if written != 10 {
+		t.Errorf("%d of the events queued before Close were written, expected 10", written)
+	}
+}
+
+func TestJSONLAnalyticsRotation(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl")
+	day := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	event := compileEvent{Time: day.Add(time.Hour), Compiler: "tinygo", Target: "wasm", Outcome: "success"}
+	line, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lineSize := int64(len(line) + 1)
+
+	// Room for two events per file, and three rotated files.
+	sink, err := newJSONLAnalytics(path, 2*lineSize, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	for i := 0; i < 5; i++ {
+		if err := sink.Write(ctx, []compileEvent{event}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countEvents := func() int64 {
+		t.Helper()
+		points, err := sink.Query(ctx, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int64
+		for _, point := range points {
+			n += point.Initial + point.Modified
+		}
+		return n
+	}
+	files, err := sink.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("got rotated files %q, expected 2", files)
+	}
+	if n := countEvents(); n != 5 {
+		t.Errorf("got %d events, expected 5", n)
+	}
+
+	// A batch is never split over two files, even if it's larger than the
+	// maximum size.
+	if err := sink.Write(ctx, []compileEvent{event, event, event}); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(path); err != nil || st.Size() != 3*lineSize {
+		t.Errorf("current file has %v bytes (error %v), expected the whole batch", st.Size(), err)
+	}
+
+	// Only the newest rotated files are kept.
+	for i := 0; i < 10; i++ {
+		if err := sink.Write(ctx, []compileEvent{event, event}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err = sink.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("got rotated files %q, expected 3", files)
+	}
+	if n := countEvents(); n != 4*2 {
+		t.Errorf("got %d events, expected the 8 in the current and the kept files", n)
+	}
+
+	// A reopened sink continues in the same file.
+	sink.Close()
+	sink, err = newJSONLAnalytics(path, 2*lineSize, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.size != 2*lineSize {
+		t.Errorf("reopened file has size %d, expected %d", sink.size, 2*lineSize)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+// This file implements storage and serving of compiled artifacts. Artifacts
+// are stored in the cache both uncompressed and precompressed, so that they
+// can be sent without compressing them on every request.
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/andybalholm/brotli"
+)
+
+// Cache-Control header for artifacts served from a content-addressed URL.
+const artifactCacheControl = "public, max-age=31536000, immutable"
+
+// Valid values for the target part of an artifact filename.
+var validTarget = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Valid values for the source hash part of an artifact filename.
+var validSourceHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// artifactEncoding is a content encoding in which compiled artifacts are
+// stored in the cache.
+type artifactEncoding struct {
+	Name     string                         // Content-Encoding value ("" for identity)
+	Suffix   string                         // suffix added to the cache filename
+	Compress func(io.Writer) io.WriteCloser // nil for identity
+}
+
+// List of encodings every artifact is stored in, in order of preference.
+var artifactEncodings = []artifactEncoding{
+	{
+		Name:   "br",
+		Suffix: ".br",
+		Compress: func(w io.Writer) io.WriteCloser {
+			return brotli.NewWriterLevel(w, 9)
+		},
+	},
+	{
+		Name:   "gzip",
+		Suffix: ".gz",
+		Compress: func(w io.Writer) io.WriteCloser {
+			gw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+			return gw
+		},
+	},
+	{
+		Name:   "",
+		Suffix: "",
+	},
+}
+
+// artifactFilename returns the path in the local cache where the artifact
+// with the given parameters is stored.
+func artifactFilename(compiler, target, sourceHash, format string) string {
+	return filepath.Join(conf.CacheDir, "build-"+compiler+"-"+target+"-"+sourceHash+"."+format)
+}
+
+// artifactURL returns the content-addressed URL at which the artifact with the
+// given parameters can be downloaded once it is cached.
+func artifactURL(compiler, target, sourceHash, format string) string {
+	return "/api/artifacts/" + compiler + "/" + target + "/" + sourceHash + "." + format
+}
+
+// artifactCached returns whether the artifact and all its precompressed
+// variants are present in the local cache. The cache is cleaned up by the
+// compiler goroutine, so only compile jobs can rely on the result: HTTP
+// handlers use openArtifact instead.
+func artifactCached(filename string) bool {
+	for _, enc := range artifactEncodings {
+		if _, err := os.Stat(filename + enc.Suffix); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// artifactExists returns whether the given artifact is cached, either locally
+// or in cloud storage, without downloading it.
+func artifactExists(ctx context.Context, filename string) (bool, error) {
+	if artifactCached(filename) {
+		return true, nil
+	}
+	if bucket == nil {
+		return false, nil
+	}
+	_, err := bucket.Object(filepath.Base(filename)).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// compressArtifact writes all precompressed variants of the given artifact
+// that don't exist yet.
+func compressArtifact(filename string) error {
+	for _, enc := range artifactEncodings {
+		if enc.Compress == nil {
+			continue
+		}
+		if _, err := os.Stat(filename + enc.Suffix); err == nil {
+			continue // already compressed
+		}
+		err := func() error {
+			r, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			tmpfile := filename + "." + randomString(16) + ".tmp"
+			defer os.Remove(tmpfile)
+			f, err := os.Create(tmpfile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			cw := enc.Compress(f)
+			if _, err := io.Copy(cw, r); err != nil {
+				return err
+			}
+			if err := cw.Close(); err != nil {
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			return os.Rename(tmpfile, filename+enc.Suffix)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadArtifact copies an artifact from cloud storage to the local cache,
+// including the precompressed variants if they were stored as well. It returns
+// false if the artifact isn't stored in the cloud.
+func downloadArtifact(ctx context.Context, filename string) (bool, error) {
+	for _, enc := range artifactEncodings {
+		r, err := bucket.Object(filepath.Base(filename) + enc.Suffix).NewReader(ctx)
+		if err != nil {
+			if enc.Compress != nil {
+				// Older cache entries only contain the uncompressed file.
+				continue
+			}
+			return false, nil
+		}
+		err = func() error {
+			defer r.Close()
+			tmpfile := filename + "." + randomString(16) + ".tmp"
+			defer os.Remove(tmpfile)
+			f, err := os.Create(tmpfile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(f, r); err != nil {
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			return os.Rename(tmpfile, filename+enc.Suffix)
+		}()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Create the variants that weren't stored in the cloud.
+	return true, compressArtifact(filename)
+}
+
+// uploadArtifact copies an artifact and its precompressed variants to cloud
+// storage, to cache them across all instances.
+func uploadArtifact(ctx context.Context, filename string) error {
+	for _, enc := range artifactEncodings {
+		err := func() error {
+			r, err := os.Open(filename + enc.Suffix)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			w := bucket.Object(filepath.Base(filename) + enc.Suffix).NewWriter(ctx)
+			if _, err := io.Copy(w, r); err != nil {
+				w.Close()
+				return err
+			}
+			return w.Close()
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// negotiateEncoding picks the preferred encoding that is acceptable according
+// to the given Accept-Encoding header.
+func negotiateEncoding(acceptEncoding string) artifactEncoding {
+	// Parse the header into a map of coding -> qvalue.
+	accepted := map[string]float64{}
+	for _, field := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(field, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) == "q" {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[coding] = q
+	}
+
+	// Pick the encoding with the highest qvalue, preferring the encodings
+	// listed first in artifactEncodings.
+	best := artifactEncodings[len(artifactEncodings)-1] // identity
+	bestQ := 0.0
+	for _, enc := range artifactEncodings {
+		name := enc.Name
+		if name == "" {
+			name = "identity"
+		}
+		q, ok := accepted[name]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if !ok {
+			if enc.Name != "" {
+				continue
+			}
+			q = 1.0 // identity is acceptable unless excluded explicitly
+		}
+		if q > bestQ {
+			best = enc
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// artifactETag returns a strong ETag for the given artifact file in the given
+// encoding. The filename already contains the source hash, so it uniquely
+// identifies the contents.
+func artifactETag(filename string, enc artifactEncoding) string {
+	return `"` + strings.TrimPrefix(filepath.Base(filename), "build-") + enc.Suffix + `"`
+}
+
+// etagMatch returns whether the If-None-Match header contains the given ETag.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setArtifactHeaders sets the headers describing a compiled artifact in the
+// given format and encoding.
+func setArtifactHeaders(w http.ResponseWriter, filename, format string, enc artifactEncoding) {
+	switch format {
+	case "wasm", "wasi":
+		w.Header().Set("Content-Type", "application/wasm")
+	case "bundle":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename=firmware.zip")
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=firmware."+format)
+	}
+	if enc.Name != "" {
+		w.Header().Set("Content-Encoding", enc.Name)
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("ETag", artifactETag(filename, enc))
+}
+
+// openArtifact opens the artifact in the given encoding from the local cache.
+// An open file can still be sent if the cache is cleaned up in the meantime.
+func openArtifact(filename string, enc artifactEncoding) (*os.File, error) {
+	return os.Open(filename + enc.Suffix)
+}
+
+// sendCompiledResult sends a compiled artifact, opened by openArtifact in the
+// given encoding.
+func sendCompiledResult(w http.ResponseWriter, r *http.Request, fp *os.File, filename, format string, enc artifactEncoding) {
+	setArtifactHeaders(w, filename, format, enc)
+	st, err := fp.Stat()
+	if err != nil {
+		logger(r.Context()).Error("could not stat compiled file", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(st.Size(), 10))
+	if r.Method == "HEAD" {
+		return
+	}
+	if _, err := io.Copy(w, fp); err != nil {
+		logger(r.Context()).Warn("could not send compiled file", "err", err)
+	}
+}
+
+// handleArtifact handles the /api/artifacts/{compiler}/{target}/{file} API
+// endpoint. It serves compiled artifacts that are already in the cache. The
+// URL includes the source hash so the response never changes, which allows
+// browsers and CDNs to cache it indefinitely.
+func handleArtifact(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag")
+
+	compiler := r.PathValue("compiler")
+	target := r.PathValue("target")
+	sourceHash, format, _ := strings.Cut(r.PathValue("file"), ".")
+	switch compiler {
+	case "go", "tinygo":
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("unrecognized compiler"))
+		return
+	}
+	if format != "wasm" && format != "wasi" && !slices.Contains(firmwareFormats, format) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("unrecognized format"))
+		return
+	}
+	if !validTarget.MatchString(target) || !validSourceHash.MatchString(sourceHash) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("invalid artifact name"))
+		return
+	}
+
+	filename := artifactFilename(compiler, target, sourceHash, format)
+	enc := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if etagMatch(r.Header.Get("If-None-Match"), artifactETag(filename, enc)) {
+		// The ETag only depends on the URL, so check that the artifact is
+		// still there. Otherwise, the request fails below.
+		exists, err := artifactExists(r.Context(), filename)
+		if err != nil {
+			logger(r.Context()).Error("could not check for artifact", "err", err)
+		}
+		if exists {
+			setArtifactHeaders(w, filename, format, enc)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	// Only serve from the cache: artifacts are created by /api/compile.
+	fp, err := openArtifact(filename, enc)
+	if errors.Is(err, os.ErrNotExist) && bucket != nil {
+		found, dlErr := downloadArtifact(r.Context(), filename)
+		if dlErr != nil {
+			logger(r.Context()).Error("could not download artifact", "err", dlErr)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if found {
+			fp, err = openArtifact(filename, enc)
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("artifact not found"))
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("could not open compiled file", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer fp.Close()
+
+	w.Header().Set("Cache-Control", artifactCacheControl)
+	sendCompiledResult(w, r, fp, filename, format, enc)
+}
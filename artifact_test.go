@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useCacheDir replaces the cache directory with an empty temporary directory
+// for the duration of the test.
+func useCacheDir(t *testing.T) string {
+	t.Helper()
+	old := conf
+	conf.CacheDir = t.TempDir()
+	t.Cleanup(func() { conf = old })
+	return conf.CacheDir
+}
+
+// writeArtifact stores an artifact with all its variants in the cache. The
+// variants contain their encoding name instead of compressed data.
+func writeArtifact(t *testing.T, filename string, modTime time.Time) {
+	t.Helper()
+	for _, enc := range artifactEncodings {
+		if err := os.WriteFile(filename+enc.Suffix, []byte("data:"+enc.Name), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename+enc.Suffix, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate, br, zstd", "br"},
+		{"BR", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0.5, gzip;q=0.5", ""},                   // identity is acceptable with q=1 unless listed
+		{"br;q=0.5, gzip;q=0.5, identity;q=0.5", "br"}, // equal, so the preferred one
+		{"br;q=0, gzip;q=0", ""},
+		{"deflate", ""},
+		{"*", "br"},
+		{"*;q=0.1, gzip", "gzip"},
+		{"identity;q=0, gzip", "gzip"},
+		{"br ; q=0.8 , identity;q=0.9", ""},
+		{"gzip;q=invalid", "gzip"},
+	} {
+		if enc := negotiateEncoding(tc.acceptEncoding); enc.Name != tc.encoding {
+			t.Errorf("Accept-Encoding %q: got %q, expected %q", tc.acceptEncoding, enc.Name, tc.encoding)
+		}
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	const etag = `"tinygo-wasm-abc.wasm.br"`
+	for _, tc := range []struct {
+		ifNoneMatch string
+		match       bool
+	}{
+		{"", false},
+		{etag, true},
+		{`W/` + etag, true},
+		{`"other", ` + etag, true},
+		{`"other",` + etag + `,"more"`, true},
+		{`"tinygo-wasm-abc.wasm"`, false}, // other encoding
+		{`tinygo-wasm-abc.wasm.br`, false},
+	} {
+		if match := etagMatch(tc.ifNoneMatch, etag); match != tc.match {
+			t.Errorf("If-None-Match %q: got %v, expected %v", tc.ifNoneMatch, match, tc.match)
+		}
+	}
+}
+
+func TestHandleArtifact(t *testing.T) {
+	useCacheDir(t)
+	hash := strings.Repeat("ab", 32)
+	filename := artifactFilename("tinygo", "wasm", hash, "wasm")
+	writeArtifact(t, filename, time.Now())
+
+	for _, tc := range []struct {
+		path, acceptEncoding, ifNoneMatch string
+		status                            int
+		body                              string
+	}{
+		{"/tinygo/wasm/" + hash + ".wasm", "gzip, br", "", 200, "data:br"},
+		{"/tinygo/wasm/" + hash + ".wasm", "gzip", "", 200, "data:gzip"},
+		{"/tinygo/wasm/" + hash + ".wasm", "", "", 200, "data:"},
+		{"/tinygo/wasm/" + hash + ".wasm", "br", artifactETag(filename, artifactEncodings[0]), 304, ""},
+		{"/tinygo/wasm/" + strings.Repeat("cd", 32) + ".wasm", "", "", 404, "artifact not found"},
+		{"/tinygo/wasm/" + strings.Repeat("cd", 32) + ".wasm", "br", artifactETag(artifactFilename("tinygo", "wasm", strings.Repeat("cd", 32), "wasm"), artifactEncodings[0]), 404, "artifact not found"},
+		{"/tinygo/wasm/" + hash + ".exe", "", "", 404, "unrecognized format"},
+		{"/gcc/wasm/" + hash + ".wasm", "", "", 404, "unrecognized compiler"},
+		{"/tinygo/wasm/abc.wasm", "", "", 404, "invalid artifact name"},
+	} {
+		r := httptest.NewRequest("GET", "/api/artifacts"+tc.path, nil)
+		parts := strings.Split(tc.path, "/")
+		r.SetPathValue("compiler", parts[1])
+		r.SetPathValue("target", parts[2])
+		r.SetPathValue("file", parts[3])
+		r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		r.Header.Set("If-None-Match", tc.ifNoneMatch)
+		w := httptest.NewRecorder()
+		handleArtifact(w, r)
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Errorf("%s (%q): got %d %q, expected %d %q", tc.path, tc.acceptEncoding, w.Code, w.Body, tc.status, tc.body)
+		}
+	}
+}
+
+func TestSendOpenedArtifact(t *testing.T) {
+	useCacheDir(t)
+	filename := artifactFilename("tinygo", "wasm", strings.Repeat("ab", 32), "wasm")
+	writeArtifact(t, filename, time.Now())
+
+	// Once opened, the artifact can be sent even if the cache is cleaned up
+	// before that.
+	enc := artifactEncodings[1]
+	fp, err := openArtifact(filename, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if err := os.Remove(filename + enc.Suffix); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	sendCompiledResult(w, httptest.NewRequest("GET", "/api/compile", nil), fp, filename, "wasm", enc)
+	if w.Code != 200 || w.Body.String() != "data:gzip" || w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Length") != "9" {
+		t.Errorf("got %d %q with headers %v", w.Code, w.Body, w.Header())
+	}
+}
+
+func TestCleanupCompileCache(t *testing.T) {
+	dir := useCacheDir(t)
+	now := time.Now()
+	var filenames []string
+	for i, age := range []time.Duration{3 * time.Hour, time.Hour, 2 * time.Hour} {
+		filename := artifactFilename("tinygo", "wasm", strings.Repeat(string(rune('a'+i)), 64), "wasm")
+		writeArtifact(t, filename, now.Add(-age))
+		filenames = append(filenames, filename)
+	}
+	// Each artifact takes 7+9+5 bytes. Keep room for two of them.
+	conf.MaxCacheSize = 60
+
+	cleanupCompileCache()
+	var left []string
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	var want []string
+	for _, filename := range filenames[1:] {
+		for _, enc := range artifactEncodings {
+			want = append(want, filepath.Base(filename)+enc.Suffix)
+		}
+	}
+	slices.Sort(want)
+	if !slices.Equal(left, want) {
+		t.Errorf("left in the cache:\n%q\nexpected the oldest artifact to be removed with all its variants:\n%q", left, want)
+	}
+	if artifactCached(filenames[0]) || !artifactCached(filenames[1]) || !artifactCached(filenames[2]) {
+		t.Error("unexpected artifacts are cached")
+	}
+}
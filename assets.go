@@ -0,0 +1,54 @@
+package main
+
+// This file embeds the frontend and the build template into the binary, so
+// that a single binary is a complete playground. Both can be overridden with
+// a directory on disk, which is useful during development.
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+//go:embed index.html *.css *.js resources parts examples worker stats
+var embeddedFrontend embed.FS
+
+// The go.mod and go.sum files of tinygo-template can't be embedded directly
+// because tinygo-template is a separate module, so they're copied to the
+// embedded directory. Run "go generate" after changing them.
+//
+//go:generate cp tinygo-template/go.mod embedded/tinygo-template.go.mod
+//go:generate cp tinygo-template/go.sum embedded/tinygo-template.go.sum
+//go:embed embedded/tinygo-template.go.mod embedded/tinygo-template.go.sum
+var embeddedTemplate embed.FS
+
+// frontendFS returns the frontend that is served: the directory set with -dir,
+// or the embedded frontend if it isn't set.
+func frontendFS() fs.FS {
+	if conf.Dir != "" {
+		return os.DirFS(conf.Dir)
+	}
+	return embeddedFrontend
+}
+
+// templateFS returns the directory with the go.mod and go.sum files used for
+// every build: the directory set with -template-dir, or the embedded template
+// if it isn't set.
+func templateFS() fs.FS {
+	if conf.TemplateDir != "" {
+		return os.DirFS(conf.TemplateDir)
+	}
+	return embeddedTemplateFS{}
+}
+
+// embeddedTemplateFS contains the embedded go.mod and go.sum files, under
+// their original names.
+type embeddedTemplateFS struct{}
+
+func (embeddedTemplateFS) Open(name string) (fs.File, error) {
+	switch name {
+	case "go.mod", "go.sum":
+		return embeddedTemplate.Open("embedded/tinygo-template." + name)
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
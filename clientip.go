@@ -0,0 +1,223 @@
+package main
+
+// This file implements resolving the address of the client that sent a
+// request, taking into account the reverse proxies in front of the server.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientAddr is the resolved client address of a request, stored in the
+// request context by withClientIP.
+type clientAddr struct {
+	Addr netip.Addr
+	Err  error // set if the address could not be determined
+}
+
+// proxyConfig describes the reverse proxies in front of the server.
+type proxyConfig struct {
+	Trusted []netip.Prefix // addresses of proxies that are always trusted
+	Hops    int            // number of proxies that are trusted regardless of their address
+}
+
+// The proxy configuration, parsed from conf at startup.
+var proxies proxyConfig
+
+// parseProxyConfig parses the trusted proxy networks (CIDRs or single
+// addresses) and hop count.
+func parseProxyConfig(trusted []string, hops int) (proxyConfig, error) {
+	pc := proxyConfig{Hops: hops}
+	if hops < 0 {
+		return pc, fmt.Errorf("invalid proxy hop count %d", hops)
+	}
+	for _, s := range trusted {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return pc, fmt.Errorf("invalid trusted proxy %q", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		pc.Trusted = append(pc.Trusted, prefix.Masked())
+	}
+	return pc, nil
+}
+
+// trusts returns whether the given address is a trusted proxy.
+func (pc *proxyConfig) trusts(addr netip.Addr) bool {
+	for _, prefix := range pc.Trusted {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the client address of the request. The chain of addresses
+// the request passed through is the list of forwarded addresses (from the
+// Forwarded header, or X-Forwarded-For if there is none) followed by the
+// address of the peer. Starting from the peer, the first address that is not
+// a proxy is the client. Proxies are the first Hops addresses, trusted
+// addresses, and Unix domain socket peers. Forwarding headers are ignored
+// unless the peer is a proxy, so they can't be spoofed by clients connecting
+// directly.
+func (pc *proxyConfig) resolve(r *http.Request) (netip.Addr, error) {
+	peer, peerErr := parsePeerAddr(r.RemoteAddr)
+	peerIsProxy := pc.Hops > 0 || peerErr == errUnixPeer || (peerErr == nil && pc.trusts(peer))
+	if !peerIsProxy {
+		return peer, peerErr
+	}
+
+	forwarded := forwardedAddrs(r.Header)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		entry := forwarded[i]
+		hop := len(forwarded) - i + 1 // the peer is hop 1
+		if i != 0 && (hop <= pc.Hops || (entry.Err == nil && pc.trusts(entry.Addr))) {
+			continue // a proxy
+		}
+		// Not a proxy, or the furthest address known: this is the client.
+		// Entries further away were added by the client or untrusted
+		// proxies, so they are never looked at.
+		if entry.Err != nil {
+			return netip.Addr{}, entry.Err
+		}
+		if !entry.Addr.IsValid() {
+			return entry.Addr, errors.New("forwarded client address is obfuscated or unknown")
+		}
+		return entry.Addr, nil
+	}
+	if peerErr == errUnixPeer {
+		return netip.Addr{}, errors.New("no forwarded address for Unix domain socket connection")
+	}
+	return peer, peerErr
+}
+
+var errUnixPeer = errors.New("connection over Unix domain socket has no client address")
+
+// parsePeerAddr parses http.Request.RemoteAddr. Connections over a Unix domain
+// socket have no IP address, and return errUnixPeer.
+func parsePeerAddr(remoteAddr string) (netip.Addr, error) {
+	if remoteAddr == "" || remoteAddr == "@" || strings.HasPrefix(remoteAddr, "/") {
+		return netip.Addr{}, errUnixPeer
+	}
+	addrport, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("could not parse remote address %q: %w", remoteAddr, err)
+	}
+	return addrport.Addr().Unmap(), nil
+}
+
+// forwardedAddr is a single address in the Forwarded or X-Forwarded-For
+// header.
+type forwardedAddr struct {
+	Addr netip.Addr // invalid if obfuscated or unknown
+	Err  error      // set if the address could not be parsed
+}
+
+// forwardedAddrs returns the client addresses in the Forwarded (RFC 7239) or
+// X-Forwarded-For header, from the original client to the last proxy.
+// Addresses that can't be parsed are returned with an error instead of
+// failing the whole header, as only the addresses added by trusted proxies
+// matter and anything before them may be garbage sent by the client.
+func forwardedAddrs(header http.Header) []forwardedAddr {
+	var addrs []forwardedAddr
+	if values := header.Values("Forwarded"); len(values) != 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				node, ok, err := forwardedFor(element)
+				if err != nil {
+					addrs = append(addrs, forwardedAddr{Err: fmt.Errorf("could not parse Forwarded header: %w", err)})
+				} else if ok {
+					addrs = append(addrs, forwardedAddr{Addr: parseForwardedNode(node)})
+				}
+			}
+		}
+		return addrs
+	}
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, item := range strings.Split(value, ",") {
+			addr, err := netip.ParseAddr(strings.TrimSpace(item))
+			if err != nil {
+				addrs = append(addrs, forwardedAddr{Err: fmt.Errorf("could not parse X-Forwarded-For header: %w", err)})
+				continue
+			}
+			addrs = append(addrs, forwardedAddr{Addr: addr.Unmap()})
+		}
+	}
+	return addrs
+}
+
+// forwardedFor returns the value of the "for" parameter in a single element
+// of a Forwarded header, like `for=192.0.2.60;proto=http;by=203.0.113.43`.
+// Quoted strings are not expected to contain commas.
+func forwardedFor(element string) (string, bool, error) {
+	for _, pair := range strings.Split(element, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return "", false, fmt.Errorf("invalid parameter %q", pair)
+		}
+		if !strings.EqualFold(strings.TrimSpace(name), "for") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+				return "", false, fmt.Errorf("invalid quoted string %s", value)
+			}
+			value = strings.ReplaceAll(value[1:len(value)-1], `\`, "")
+		}
+		return value, true, nil
+	}
+	return "", false, nil
+}
+
+// parseForwardedNode parses a node in the Forwarded header: an IPv4 address or
+// bracketed IPv6 address, optionally with a port. Obfuscated identifiers and
+// "unknown" result in an invalid address.
+func parseForwardedNode(node string) netip.Addr {
+	if addr, err := netip.ParseAddr(node); err == nil {
+		return addr.Unmap()
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			return addr.Unmap()
+		}
+	}
+	if strings.HasPrefix(node, "[") && strings.HasSuffix(node, "]") {
+		if addr, err := netip.ParseAddr(node[1 : len(node)-1]); err == nil {
+			return addr
+		}
+	}
+	return netip.Addr{}
+}
+
+// withClientIP wraps a HTTP handler to resolve the client address of every
+// request once, see clientIP.
+func withClientIP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := proxies.resolve(r)
+		ctx := context.WithValue(r.Context(), clientIPKey, clientAddr{addr, err})
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the client address of the request that the context
+// belongs to.
+func clientIP(ctx context.Context) (netip.Addr, error) {
+	client, ok := ctx.Value(clientIPKey).(clientAddr)
+	if !ok {
+		return netip.Addr{}, errors.New("no client address in context")
+	}
+	return client.Addr, client.Err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestForwardedAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		addrs  []string // "" for obfuscated or unknown, "error: ..." for an error containing the text
+	}{
+		{"none", http.Header{}, nil},
+		{"X-Forwarded-For", http.Header{"X-Forwarded-For": {"203.0.113.195, 70.41.3.18", "150.172.238.178"}}, []string{"203.0.113.195", "70.41.3.18", "150.172.238.178"}},
+		{"X-Forwarded-For IPv6", http.Header{"X-Forwarded-For": {"2001:db8:85a3:8d3:1319:8a2e:370:7348, ::ffff:192.0.2.1"}}, []string{"2001:db8:85a3:8d3:1319:8a2e:370:7348", "192.0.2.1"}},
+		{"X-Forwarded-For invalid", http.Header{"X-Forwarded-For": {"203.0.113.195, unknown"}}, []string{"203.0.113.195", "error: could not parse X-Forwarded-For"}},
+
+		// The examples of RFC 7239.
+		{"Forwarded", http.Header{"Forwarded": {`for="_gazonk"`}}, []string{""}},
+		{"Forwarded IPv6", http.Header{"Forwarded": {`For="[2001:db8:cafe::17]:4711"`}}, []string{"2001:db8:cafe::17"}},
+		{"Forwarded parameters", http.Header{"Forwarded": {`for=192.0.2.60;proto=http;by=203.0.113.43`}}, []string{"192.0.2.60"}},
+		{"Forwarded list", http.Header{"Forwarded": {`for=192.0.2.43, for=198.51.100.17`}}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"Forwarded unknown", http.Header{"Forwarded": {`for=unknown, for=198.51.100.17;by=unknown`}}, []string{"", "198.51.100.17"}},
+		{"Forwarded quoted IPv4 with port", http.Header{"Forwarded": {`for="192.0.2.43:47011"`}}, []string{"192.0.2.43"}},
+		{"Forwarded quoted IPv6", http.Header{"Forwarded": {`for="[2001:db8::1]"`}}, []string{"2001:db8::1"}},
+		{"Forwarded quoted-pair", http.Header{"Forwarded": {`for="\[2001:db8::1\]"`}}, []string{"2001:db8::1"}},
+		{"Forwarded without for", http.Header{"Forwarded": {`proto=https;by=203.0.113.43`}}, nil},
+		{"Forwarded multiple headers", http.Header{"Forwarded": {`for=192.0.2.43`, `for=198.51.100.17`}}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"Forwarded over X-Forwarded-For", http.Header{"Forwarded": {`for=192.0.2.43`}, "X-Forwarded-For": {"198.51.100.17"}}, []string{"192.0.2.43"}},
+		{"Forwarded unterminated quote", http.Header{"Forwarded": {`for="192.0.2.43`}}, []string{"error: invalid quoted string"}},
+		{"Forwarded invalid parameter", http.Header{"Forwarded": {`for, for=192.0.2.43`}}, []string{"error: invalid parameter", "192.0.2.43"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addrs := forwardedAddrs(tc.header)
+			if len(addrs) != len(tc.addrs) {
+				t.Fatalf("got %v, expected %q", addrs, tc.addrs)
+			}
+			for i, s := range tc.addrs {
+				want := forwardedAddr{}
+				if msg, ok := strings.CutPrefix(s, "error: "); ok {
+					if addrs[i].Err == nil || !strings.Contains(addrs[i].Err.Error(), msg) {
+						t.Errorf("address %d: got %v, expected an error containing %q", i, addrs[i], msg)
+					}
+					continue
+				}
+				if s != "" {
+					want.Addr = netip.MustParseAddr(s)
+				}
+				if addrs[i] != want {
+					t.Errorf("address %d: got %v, expected %s", i, addrs[i], s)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyConfigResolve(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		trusted    []string
+		hops       int
+		remoteAddr string
+		header     http.Header
+		client     string // empty if an error is expected
+	}{
+		{"direct", nil, 0, "198.51.100.17:1234", nil, "198.51.100.17"},
+		{"direct IPv6", nil, 0, "[2001:db8::1]:1234", nil, "2001:db8::1"},
+		{"direct IPv4-mapped", nil, 0, "[::ffff:198.51.100.17]:1234", nil, "198.51.100.17"},
+
+		// Clients that connect directly can't pretend to be someone else.
+		{"spoofed X-Forwarded-For", nil, 0, "198.51.100.17:1234", http.Header{"X-Forwarded-For": {"192.0.2.1"}}, "198.51.100.17"},
+		{"spoofed Forwarded", []string{"10.0.0.0/8"}, 0, "198.51.100.17:1234", http.Header{"Forwarded": {"for=192.0.2.1"}}, "198.51.100.17"},
+
+		// One proxy in front of the server (Cloud Run), which appends the
+		// address it received the request from.
+		{"hops", nil, 1, "169.254.1.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.17"}}, "198.51.100.17"},
+		{"hops spoofed", nil, 1, "169.254.1.1:1234", http.Header{"X-Forwarded-For": {"192.0.2.1, 198.51.100.17"}}, "198.51.100.17"},
+		{"hops without header", nil, 1, "169.254.1.1:1234", nil, "169.254.1.1"},
+		{"two hops", nil, 2, "169.254.1.1:1234", http.Header{"X-Forwarded-For": {"192.0.2.1, 198.51.100.17, 10.1.2.3"}}, "198.51.100.17"},
+
+		// Trusted proxies by address.
+		{"trusted", []string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.17"}}, "198.51.100.17"},
+		{"trusted chain", []string{"10.0.0.0/8", "192.0.2.5"}, 0, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"192.0.2.1, 198.51.100.17, 192.0.2.5, 10.9.9.9"}}, "198.51.100.17"},
+		{"all trusted", []string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.2, 10.0.0.3"}}, "10.0.0.2"},
+		{"trusted Forwarded", []string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", http.Header{"Forwarded": {`for="[2001:db8::1]:4711"`}}, "2001:db8::1"},
+		{"trusted obfuscated", []string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", http.Header{"Forwarded": {`for=_hidden`}}, ""},
+		{"trusted invalid header", []string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"nonsense"}}, ""},
+		{"trusted invalid proxy", []string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.17, nonsense"}}, ""},
+
+		// Garbage sent by the client before the trusted hops is ignored.
+		{"hops garbage", nil, 1, "169.254.1.1:1234", http.Header{"X-Forwarded-For": {"nonsense, 198.51.100.17"}}, "198.51.100.17"},
+		{"hops garbage Forwarded", nil, 1, "169.254.1.1:1234", http.Header{"Forwarded": {`for="nonsense, for=198.51.100.17`}}, "198.51.100.17"},
+		{"trusted garbage", []string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"nonsense, 198.51.100.17, 10.0.0.2"}}, "198.51.100.17"},
+
+		// A reverse proxy on the same machine, connected over a Unix socket.
+		{"unix", nil, 0, "@", http.Header{"X-Forwarded-For": {"198.51.100.17"}}, "198.51.100.17"},
+		{"unix without header", nil, 0, "", nil, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pc, err := parseProxyConfig(tc.trusted, tc.hops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for name, values := range tc.header {
+				r.Header[name] = values
+			}
+			addr, err := pc.resolve(r)
+			if tc.client == "" {
+				if err == nil {
+					t.Errorf("got %v, expected an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr != netip.MustParseAddr(tc.client) {
+				t.Errorf("got %v, expected %s", addr, tc.client)
+			}
+		})
+	}
+}
+
+func TestParseProxyConfig(t *testing.T) {
+	pc, err := parseProxyConfig([]string{"10.1.2.3/8", "192.0.2.5", "2001:db8::/32"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.5/32"), netip.MustParsePrefix("2001:db8::/32")}
+	if !slices.Equal(pc.Trusted, want) || pc.Hops != 1 {
+		t.Errorf("got %+v", pc)
+	}
+	if !pc.trusts(netip.MustParseAddr("::ffff:10.9.9.9")) {
+		t.Error("IPv4-mapped address in a trusted network is not trusted")
+	}
+	for _, trusted := range []string{"10.0.0.0/33", "proxy.example.com"} {
+		if _, err := parseProxyConfig([]string{trusted}, 0); err == nil {
+			t.Errorf("invalid trusted proxy %q was accepted", trusted)
+		}
+	}
+	if _, err := parseProxyConfig(nil, -1); err == nil {
+		t.Error("negative hop count was accepted")
+	}
+}
@@ -3,63 +3,184 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
-	"io"
+	"fmt"
+	"io/fs"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	maxCacheSize = 10 * 1000 * 1000 // 10MB
+	uploadTimeout = time.Minute // maximum time to upload an artifact to cloud storage
+)
+
+// Returned when a job can't be queued because the server is shutting down.
+var errDraining = errors.New("server is shutting down")
+
+var (
+	// Set when the server is shutting down, to refuse new compile jobs.
+	draining atomic.Bool
+
+	// Compile jobs that are queued or running.
+	activeJobs sync.WaitGroup
+
+	// Held while checking draining and adding a job to activeJobs, so that
+	// no job can be added once the server has started draining, while
+	// waitForJobs may be waiting.
+	drainLock sync.Mutex
 )
 
 type compilerJob struct {
-	Source       []byte      // source code of program to compile
-	SourceHash   string      // sha256 of source (in hex form)
-	Filename     string      // cache file path
-	Compiler     string      // compiler to use for this job
-	Target       string      // target board name, or "wasm"
-	Format       string      // output format: "wasm", "hex", etc.
-	ResultFile   chan string // filename on completion
-	ResultErrors chan []byte // errors on completion
+	Source       []byte           // source code of program to compile
+	SourceHash   string           // sha256 of source (in hex form)
+	Filename     string           // cache file path
+	Compiler     string           // compiler to use for this job
+	Target       string           // target board name
+	Board        *partDefinition  // definition of the target board
+	Format       string           // output format: "wasm", "hex", etc.
+	Encoding     artifactEncoding // encoding of the file sent on ResultFile
+	ResultFile   chan *os.File    // opened artifact on completion, closed by the receiver
+	ResultErrors chan []byte      // errors on completion
 	Context      context.Context
+	Queued       time.Time     // time the job was created
+	RequestID    string        // ID of the HTTP request that created the job, if any
+	Stats        *compileStats // filled in before sending the result
+}
+
+// logger returns a logger with the attributes identifying this job.
+func (job compilerJob) logger() *slog.Logger {
+	l := slog.With("compiler", job.Compiler, "target", job.Target, "format", job.Format)
+	if job.RequestID != "" {
+		l = l.With("request_id", job.RequestID)
+	}
+	return l
+}
+
+// queueJob sends a job to the background compiler. It blocks until the
+// compiler is ready to start the job, and fails if the server is shutting
+// down.
+func queueJob(job compilerJob) error {
+	drainLock.Lock()
+	if draining.Load() {
+		drainLock.Unlock()
+		return errDraining
+	}
+	activeJobs.Add(1)
+	drainLock.Unlock()
+	metricQueueDepth.Add(1)
+	compilerChan <- job
+	return nil
+}
+
+// startDraining refuses new compile jobs, when the server is shutting down.
+// Jobs that were queued before are still run, see waitForJobs.
+func startDraining() {
+	drainLock.Lock()
+	draining.Store(true)
+	drainLock.Unlock()
+}
+
+// waitForJobs waits until all queued and running compile jobs have finished,
+// or until the context is done.
+func waitForJobs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		activeJobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// compileSource compiles a program through the compile queue, the same way
+// handleCompile does, and waits for the result.
+func compileSource(ctx context.Context, source []byte, compiler string, board *partDefinition, format string) error {
+	sourceHashRaw := sha256.Sum256(source)
+	sourceHash := hex.EncodeToString(sourceHashRaw[:])
+	job := compilerJob{
+		Source:       source,
+		SourceHash:   sourceHash,
+		Filename:     artifactFilename(compiler, board.Name, sourceHash, format),
+		Compiler:     compiler,
+		Target:       board.Name,
+		Board:        board,
+		Format:       format,
+		Context:      ctx,
+		ResultFile:   make(chan *os.File),
+		ResultErrors: make(chan []byte),
+		Queued:       time.Now(),
+		RequestID:    requestID(ctx),
+		Stats:        &compileStats{},
+	}
+	if err := queueJob(job); err != nil {
+		return err
+	}
+	select {
+	case fp := <-job.ResultFile:
+		return fp.Close()
+	case buf := <-job.ResultErrors:
+		return errors.New(string(buf))
+	}
 }
 
 // Started in the background, to limit the number of concurrent compiles.
 func backgroundCompiler(ch chan compilerJob) {
 	n := 0
 	for job := range ch {
+		metricQueueDepth.Add(-1)
+		job.Stats.QueueWait = time.Since(job.Queued)
+		metricQueueWait.Observe(job.Stats.QueueWait.Seconds())
 		n++
+		// Don't let a single program hold up the queue forever.
+		cancel := context.CancelFunc(func() {})
+		if conf.CompileTimeout > 0 {
+			job.Context, cancel = context.WithTimeout(job.Context, time.Duration(conf.CompileTimeout))
+		}
 		err := job.Run()
 		if err != nil {
+			if job.Context.Err() != nil {
+				job.Stats.Outcome = contextOutcome(job.Context)
+			} else {
+				job.Stats.Outcome = "error"
+			}
 			buf := &bytes.Buffer{}
 			buf.WriteString(err.Error())
 			job.ResultErrors <- buf.Bytes()
 		}
+		cancel()
 		if n%100 == 1 {
 			cleanupCompileCache()
 		}
+		activeJobs.Done()
 	}
 }
 
 // Run a single compiler job. It tries to load from the cache and kills the job
 // (or even refuses to start) if this job was cancelled through the context.
 func (job compilerJob) Run() error {
-	outfileName := filepath.Base(job.Filename)
-
 	// Attempt to load the file from the cache.
-	_, err := os.Stat(job.Filename)
-	if err == nil {
+	if artifactCached(job.Filename) {
 		// Cache hit!
-		job.ResultFile <- job.Filename
-		return nil
+		job.logger().Info("compile served from cache", "cache", "local")
+		job.Stats.CacheTier = "local"
+		job.Stats.Outcome = "success"
+		return job.sendResult()
 	}
 
 	// Perhaps the job should not even be started.
@@ -72,80 +193,155 @@ func (job compilerJob) Run() error {
 		// Not cancelled.
 	}
 
-	tmpfile := filepath.Join(cacheDir, "build-"+job.Compiler+"-"+job.Target+"-"+randomString(16)+".tmp."+job.Format)
+	if bucket != nil {
+		start := time.Now()
+		found, err := downloadArtifact(job.Context, job.Filename)
+		if err != nil {
+			return err
+		}
+		if found {
+			// File was already cached in the cloud but not locally. Return
+			// the file that is now cached locally.
+			metricCacheHits.Inc("gcs")
+			job.logger().Info("compile served from cache", "cache", "gcs", "duration", time.Since(start))
+			job.Stats.CacheTier = "gcs"
+			job.Stats.Outcome = "success"
+			return job.sendResult()
+		}
+		metricCacheMisses.Inc("gcs")
+	}
+
+	// Cache miss, compile now. Firmware in formats other than ELF is derived
+	// from the ELF file, so that downloading a program in several formats
+	// only builds it once.
+	tmpfile := job.tempFilename()
 	defer os.Remove(tmpfile)
+	var compileErrors []byte
+	var err error
+	if job.Compiler == "tinygo" && job.Format != "elf" && slices.Contains(firmwareFormats, job.Format) {
+		compileErrors, err = job.deriveFromELF(tmpfile)
+	} else {
+		compileErrors, err = job.build(tmpfile)
+	}
+	if err != nil {
+		return err
+	}
+	if compileErrors != nil {
+		job.ResultErrors <- compileErrors
+		return nil
+	}
+	if err := job.store(tmpfile); err != nil {
+		return err
+	}
 
-	if bucket != nil {
-		r, err := bucket.Object(outfileName).NewReader(job.Context)
-		if err == nil {
-			// File is already cached in the cloud.
-			defer r.Close()
-
-			// Copy the file (that is already cached in the cloud but not locally)
-			// to the local cache.
-			f, err := os.Create(tmpfile)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			if _, err := io.Copy(f, r); err != nil {
-				return err
-			}
+	// Done. Return the local file.
+	job.Stats.Outcome = "success"
+	return job.sendResult()
+}
 
-			if err := os.Rename(tmpfile, job.Filename); err != nil {
-				return err
-			}
+// sendResult sends the artifact of the job to the waiting handler. The file is
+// opened here, before the compiler goroutine can clean up the cache, so that
+// the handler can always send it.
+func (job compilerJob) sendResult() error {
+	fp, err := openArtifact(job.Filename, job.Encoding)
+	if err != nil {
+		return err
+	}
+	job.ResultFile <- fp
+	return nil
+}
 
-			// Done. Return the file that is now cached locally.
-			job.ResultFile <- job.Filename
-			return nil
+// tempFilename returns a new file path in the cache directory to build the
+// artifact in, before it is moved to its final place.
+func (job compilerJob) tempFilename() string {
+	return filepath.Join(conf.CacheDir, "build-"+job.Compiler+"-"+job.Target+"-"+randomString(16)+".tmp."+job.Format)
+}
+
+// deriveFromELF writes the firmware in the format of the job to tmpfile,
+// converted from the ELF file of the same program. The ELF file is taken from
+// the cache, or built and cached if it isn't there yet. It returns the
+// compiler errors if the program could not be built.
+func (job compilerJob) deriveFromELF(tmpfile string) ([]byte, error) {
+	elfJob := job
+	elfJob.Format = "elf"
+	elfJob.Filename = artifactFilename(job.Compiler, job.Target, job.SourceHash, "elf")
+	cache := "local"
+	found := artifactCached(elfJob.Filename)
+	if !found && bucket != nil {
+		var err error
+		found, err = downloadArtifact(job.Context, elfJob.Filename)
+		if err != nil {
+			return nil, err
+		}
+		cache = "gcs"
+	}
+	if found {
+		job.Stats.CacheTier = "elf"
+		job.logger().Info("firmware derived from cached ELF", "cache", cache)
+	} else {
+		elfTmpfile := elfJob.tempFilename()
+		defer os.Remove(elfTmpfile)
+		compileErrors, err := elfJob.build(elfTmpfile)
+		if err != nil || compileErrors != nil {
+			return compileErrors, err
+		}
+		if err := elfJob.store(elfTmpfile); err != nil {
+			return nil, err
 		}
 	}
 
-	// Cache miss, compile now.
-	// But first write the Go source code to a file so it can be read by the
-	// compiler.
+	data, err := convertFirmware(elfJob.Filename, job.Format, job.Board)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert firmware to %s: %w", job.Format, err)
+	}
+	return nil, os.WriteFile(tmpfile, data, 0o666)
+}
+
+// build compiles the program of the job to tmpfile. It returns the compiler
+// errors if the program could not be built.
+func (job compilerJob) build(tmpfile string) ([]byte, error) {
+	// Write the Go source code to a file so it can be read by the compiler.
 	tmpdir, err := os.MkdirTemp("", "tinygo-playground-*")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer os.RemoveAll(tmpdir)
 	for _, fn := range []string{"go.mod", "go.sum"} {
-		data, err := os.ReadFile("tinygo-template/" + fn)
+		data, err := fs.ReadFile(templateFS(), fn)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		err = os.WriteFile(tmpdir+"/"+fn, data, 0o666)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 	infile, err := os.Create(tmpdir + "/main.go")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if _, err := infile.Write([]byte("//line main.go:1:1\n")); err != nil {
-		return err
+		return nil, err
 	}
 	if _, err := infile.Write(job.Source); err != nil {
-		return err
+		return nil, err
 	}
 
 	var cmd *exec.Cmd
 	env := []string{"GOPROXY=off"} // don't download dependencies
 	switch job.Compiler {
 	case "go":
-		cmd = exec.Command("go", "build", "-json", "-trimpath", "-ldflags", "-s -w", "-o", tmpfile, infile.Name())
+		cmd = exec.CommandContext(job.Context, "go", "build", "-json", "-trimpath", "-ldflags", "-s -w", "-o", tmpfile, infile.Name())
 		env = append(env, "GOOS=wasip1", "GOARCH=wasm")
 	case "tinygo":
 		switch job.Format {
 		case "wasm", "wasi":
 			// simulate
-			tag := strings.Replace(job.Target, "-", "_", -1) // '-' not allowed in tags, use '_' instead
-			cmd = exec.Command("tinygo", "build", "-json", "-o", tmpfile, "-target", job.Format, "-tags", tag, "-no-debug", infile.Name())
+			tags := strings.Join(job.Board.buildTags(), ",")
+			cmd = exec.CommandContext(job.Context, "tinygo", "build", "-json", "-o", tmpfile, "-target", job.Format, "-tags", tags, "-no-debug", infile.Name())
 		default:
 			// build firmware
-			cmd = exec.Command("tinygo", "build", "-json", "-o", tmpfile, "-target", job.Target, infile.Name())
+			cmd = exec.CommandContext(job.Context, "tinygo", "build", "-json", "-o", tmpfile, "-target", job.Board.buildTarget(), infile.Name())
 		}
 	}
 	buf := &bytes.Buffer{}
@@ -153,88 +349,142 @@ func (job compilerJob) Run() error {
 	cmd.Stderr = buf
 	cmd.Dir = filepath.Dir(infile.Name()) // avoid long relative paths in error messages
 	cmd.Env = append(os.Environ(), env...)
-	finishedChan := make(chan struct{})
-	func() {
-		defer close(finishedChan)
-		err := cmd.Run()
-		if err != nil {
-			if buf.Len() == 0 {
-				buf.WriteString(err.Error())
-			}
-			job.ResultErrors <- stripFilename(buf.Bytes(), infile.Name())
-			return
+	start := time.Now()
+	job.logger().Info("compile started", "cache", "miss", "queue_wait", start.Sub(job.Queued))
+	err = cmd.Run()
+	duration := time.Since(start)
+	job.Stats.CacheTier = "build"
+	job.Stats.BuildDuration = duration
+	metricCompileDuration.Observe(duration.Seconds(), job.Compiler, job.Target, job.Format)
+	job.logger().Info("compile finished", "cache", "miss", "duration", duration, "exit_status", exitStatus(err))
+	if err != nil {
+		metricCompiles.Inc(job.Compiler, job.Target, job.Format, "failure")
+		if errors.Is(job.Context.Err(), context.DeadlineExceeded) {
+			// The compiler was killed because it took too long.
+			return nil, errors.New("compile timed out")
+		}
+		if job.Context.Err() != nil {
+			// The compiler was killed because the job was cancelled.
+			return nil, errors.New("aborted")
 		}
-		if err := os.Rename(tmpfile, job.Filename); err != nil {
-			// unlikely
+		if buf.Len() == 0 {
 			buf.WriteString(err.Error())
-			job.ResultErrors <- buf.Bytes()
-			return
 		}
+		job.Stats.Outcome = "compile-error"
+		job.Stats.ErrorClass = classifyCompileError(buf.Bytes())
+		return stripFilename(buf.Bytes(), infile.Name()), nil
+	}
+	metricCompiles.Inc(job.Compiler, job.Target, job.Format, "success")
+	return nil, nil
+}
 
-		// Now copy the file over to cloud storage to cache across all
-		// instances.
-		if cacheType == cacheTypeGCS {
-			obj := bucket.Object(outfileName)
-			w := obj.NewWriter(job.Context)
-			r, err := os.Open(job.Filename)
-			if err != nil {
-				log.Println(err.Error())
-				return
-			}
-			defer r.Close()
-			if _, err := io.Copy(w, r); err != nil {
-				log.Println(err.Error())
-				return
-			}
-			if err := w.Close(); err != nil {
-				log.Println(err.Error())
-				return
-			}
-		}
+// store moves the built artifact in tmpfile to its place in the cache, with
+// its precompressed variants, and uploads it to cloud storage if configured.
+func (job compilerJob) store(tmpfile string) error {
+	if err := os.Rename(tmpfile, job.Filename); err != nil {
+		// unlikely
+		return err
+	}
 
-		// Done. Return the local file immediately.
-		job.ResultFile <- job.Filename
-	}()
-	select {
-	case <-finishedChan:
-		// Job was completed before a cancellation.
-	case <-job.Context.Done():
-		// Job should be killed: it's useless now.
-		cmd.Process.Kill()
+	// Store precompressed variants, so they don't need to be compressed on
+	// every request.
+	if err := compressArtifact(job.Filename); err != nil {
+		return err
+	}
+
+	// Now copy the file over to cloud storage to cache across all instances.
+	// Don't abandon the upload halfway if the job is cancelled now: the work
+	// has already been done.
+	if cacheType == cacheTypeGCS {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(job.Context), uploadTimeout)
+		defer cancel()
+		if err := uploadArtifact(ctx, job.Filename); err != nil {
+			// Not fatal: the file is still cached locally.
+			job.logger().Error("could not upload artifact", "err", err)
+		}
 	}
 	return nil
 }
 
+// contextOutcome returns the outcome of a compile job that was stopped because
+// its context is done: "timeout" if it ran longer than conf.CompileTimeout (or
+// the deadline of the request), or "cancelled".
+func contextOutcome(ctx context.Context) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "timeout"
+	}
+	return "cancelled"
+}
+
 // cleanupCompileCache is called regularly to clean up old compile results from
-// the cache if the cache has grown too big.
+// the cache if the cache has grown too big. An artifact and its precompressed
+// variants are removed together, as an artifact is only cached if all of them
+// are present.
 func cleanupCompileCache() {
 	totalSize := int64(0)
-	files, err := ioutil.ReadDir(cacheDir)
+	files, err := ioutil.ReadDir(conf.CacheDir)
 	if err != nil {
-		log.Println("could not read cache dir: ", err)
+		slog.Error("could not read cache dir", "err", err)
 		return
 	}
+	type cacheEntry struct {
+		names   []string
+		size    int64
+		modTime time.Time // of the most recently written file
+	}
+	entries := make(map[string]*cacheEntry)
 	for _, fi := range files {
 		totalSize += fi.Size()
+		base := fi.Name()
+		for _, enc := range artifactEncodings {
+			if enc.Suffix != "" && strings.HasSuffix(base, enc.Suffix) {
+				base = strings.TrimSuffix(base, enc.Suffix)
+				break
+			}
+		}
+		entry := entries[base]
+		if entry == nil {
+			entry = &cacheEntry{}
+			entries[base] = entry
+		}
+		entry.names = append(entry.names, fi.Name())
+		entry.size += fi.Size()
+		if fi.ModTime().After(entry.modTime) {
+			entry.modTime = fi.ModTime()
+		}
 	}
-	if totalSize > maxCacheSize {
+	defer func() {
+		metricCacheSize.Set(float64(totalSize))
+	}()
+	if totalSize > conf.MaxCacheSize {
 		// Sort by modification time.
-		sort.Slice(files, func(i, j int) bool {
-			if files[i].ModTime().UnixNano() != files[j].ModTime().UnixNano() {
-				return files[i].ModTime().UnixNano() < files[j].ModTime().UnixNano()
+		bases := make([]string, 0, len(entries))
+		for base := range entries {
+			bases = append(bases, base)
+		}
+		sort.Slice(bases, func(i, j int) bool {
+			a, b := entries[bases[i]], entries[bases[j]]
+			if !a.modTime.Equal(b.modTime) {
+				return a.modTime.Before(b.modTime)
 			}
-			return files[i].Name() < files[j].Name()
+			return bases[i] < bases[j]
 		})
 
-		// Remove all the oldest files.
-		for totalSize > maxCacheSize {
-			file := files[0]
-			totalSize -= file.Size()
-			err := os.Remove(filepath.Join(cacheDir, file.Name()))
-			if err != nil {
-				log.Println("failed to remove cache file:", err)
+		// Remove all the oldest artifacts.
+		for _, base := range bases {
+			if totalSize <= conf.MaxCacheSize {
+				break
+			}
+			entry := entries[base]
+			totalSize -= entry.size
+			for _, name := range entry.names {
+				err := os.Remove(filepath.Join(conf.CacheDir, name))
+				if err != nil {
+					slog.Error("failed to remove cache file", "err", err)
+				} else {
+					metricCacheEvictions.Inc()
+				}
 			}
-			files = files[1:]
 		}
 	}
 }
@@ -250,6 +500,18 @@ func randomString(length int) string {
 	return string(b)
 }
 
+// exitStatus returns the exit status of a command from the error returned by
+// cmd.Run, or -1 if the command didn't exit normally.
+func exitStatus(err error) int {
+	var exitErr *exec.ExitError
+	if err == nil {
+		return 0
+	} else if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
 func stripFilename(buf []byte, filename string) []byte {
 	prefix := []byte("# " + filename + "\n")
 	if bytes.HasPrefix(buf, prefix) {
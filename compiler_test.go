@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useBackgroundCompiler starts a background compiler for the duration of the
+// test, with an empty cache directory.
+func useBackgroundCompiler(t *testing.T) {
+	t.Helper()
+	useCacheDir(t)
+	ch := make(chan compilerJob)
+	oldChan := compilerChan
+	compilerChan = ch
+	done := make(chan struct{})
+	go func() {
+		backgroundCompiler(ch)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		// Wait for the compiler to finish (including cleaning up the cache)
+		// before the configuration is restored.
+		close(ch)
+		<-done
+		compilerChan = oldChan
+	})
+}
+
+// testJob returns a compile job that can't be served from the cache.
+func testJob() compilerJob {
+	return compilerJob{
+		Source:       []byte("package main"),
+		SourceHash:   "0000",
+		Filename:     artifactFilename("go", "console", "0000", "wasi"),
+		Compiler:     "go",
+		Target:       "console",
+		Board:        &partDefinition{Name: "console"},
+		Format:       "wasi",
+		Context:      context.Background(),
+		ResultFile:   make(chan *os.File),
+		ResultErrors: make(chan []byte),
+		Queued:       time.Now(),
+		Stats:        &compileStats{},
+	}
+}
+
+func TestCompileTimeout(t *testing.T) {
+	useBackgroundCompiler(t)
+	conf.CompileTimeout = duration(time.Nanosecond)
+
+	job := testJob()
+	if err := queueJob(job); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case fp := <-job.ResultFile:
+		fp.Close()
+		t.Fatal("job finished, expected it to time out")
+	case <-job.ResultErrors:
+	}
+	if job.Stats.Outcome != "timeout" {
+		t.Errorf("outcome %q, expected timeout", job.Stats.Outcome)
+	}
+}
+
+func TestQueueJobDraining(t *testing.T) {
+	useBackgroundCompiler(t)
+	conf.CompileTimeout = duration(time.Nanosecond) // finish jobs right away
+	t.Cleanup(func() { draining.Store(false) })
+
+	// Queue jobs while the server starts draining: every job is either
+	// refused, or waited for.
+	var wg sync.WaitGroup
+	var queued atomic.Int32
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job := testJob()
+				if err := queueJob(job); err != nil {
+					if err != errDraining {
+						t.Error(err)
+					}
+					return
+				}
+				queued.Add(1)
+				go func() { <-job.ResultErrors }()
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	startDraining()
+	if err := waitForJobs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if err := queueJob(testJob()); err != errDraining {
+		t.Errorf("job queued while draining: %v", err)
+	}
+	if queued.Load() == 0 {
+		t.Error("no jobs were queued before draining")
+	}
+}
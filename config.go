@@ -0,0 +1,269 @@
+package main
+
+// This file implements the server configuration. Every option can be set in a
+// JSON configuration file, in an environment variable and as a command line
+// flag, in increasing order of precedence.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// config contains all configuration options of the server.
+type config struct {
+	Listen              stringList `json:"listen"`              // addresses to listen on, see openListeners
+	TLSCert             string     `json:"tlsCert"`             // certificate file for "tls:" listeners
+	TLSKey              string     `json:"tlsKey"`              // private key file for "tls:" listeners
+	Dir                 string     `json:"dir"`                 // directory with the frontend, empty to use the embedded frontend
+	CacheDir            string     `json:"cacheDir"`            // directory for compiled artifacts
+	CSP                 string     `json:"csp"`                 // Content-Security-Policy header of the frontend, empty to omit it
+	APIOrigin           string     `json:"apiOrigin"`           // origin of the API if the frontend talks to another server, see contentSecurityPolicy
+	ReferrerPolicy      string     `json:"referrerPolicy"`      // Referrer-Policy header of the frontend, empty to omit it
+	TemplateDir         string     `json:"templateDir"`         // directory with go.mod and go.sum for builds, empty to use the embedded files
+	TrustedProxies      stringList `json:"trustedProxies"`      // CIDRs of reverse proxies, see proxyConfig
+	ProxyHops           int        `json:"proxyHops"`           // number of reverse proxies in front of the server
+	CacheType           string     `json:"cacheType"`           // "local" or "gcs"
+	BucketName          string     `json:"bucketName"`          // Google Cloud Storage bucket (for cacheType "gcs")
+	FirebaseCredentials string     `json:"firebaseCredentials"` // path to credentials, empty on Google Cloud
+	MaxCacheSize        int64      `json:"maxCacheSize"`        // maximum size of the cache directory in bytes
+	MaxShareSize        int64      `json:"maxShareSize"`        // maximum size of a shared snippet in bytes
+	CompileTimeout      duration   `json:"compileTimeout"`      // maximum time to run a single compile job
+	ShareStorage        string     `json:"shareStorage"`        // "firestore", "file", "bolt" or "memory"
+	SharePath           string     `json:"sharePath"`           // directory (file) or database (bolt) for shares
+	ShareSweepInterval  duration   `json:"shareSweepInterval"`  // how often to delete expired shares
+	ShareIPMode         string     `json:"shareIPMode"`         // "obfuscated", "hash" or "none", see getStoredIP
+	IPRetentionDays     int        `json:"ipRetentionDays"`     // days after which IP addresses are removed from shares
+	AnalyticsSink       string     `json:"analyticsSink"`       // "disabled", "firestore", "jsonl" or "memory"
+	AnalyticsPath       string     `json:"analyticsPath"`       // file for the "jsonl" analytics sink
+	AnalyticsMaxSize    int64      `json:"analyticsMaxSize"`    // size at which the analytics file is rotated
+	AnalyticsMaxFiles   int        `json:"analyticsMaxFiles"`   // number of rotated analytics files to keep
+	StatsCacheTTL       duration   `json:"statsCacheTTL"`       // how long to cache /api/stats results
+	DrainTimeout        duration   `json:"drainTimeout"`        // time to let requests finish on shutdown
+	LogLevel            string     `json:"logLevel"`            // "debug", "info", "warn" or "error"
+	LogFormat           string     `json:"logFormat"`           // "text" or "json"
+	GoVersion           string     `json:"goVersion"`           // expected by the readiness check
+	TinyGoVersion       string     `json:"tinygoVersion"`       // expected by the readiness check
+	ReadyzSmokeTest     bool       `json:"readyzSmokeTest"`     // compile a program at startup for the readiness check
+}
+
+// The configuration of the server, set at startup.
+var conf config
+
+// Content-Security-Policy of the frontend by default. The frontend talks to
+// the API (see contentSecurityPolicy if that is another server), runs
+// WebAssembly and sets inline styles on the schematic.
+const defaultCSP = "default-src 'self'; " +
+	"script-src 'self' 'wasm-unsafe-eval'; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data: blob:; " +
+	"connect-src 'self'; " +
+	"form-action 'self'; " +
+	"worker-src 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"frame-ancestors 'none'"
+
+// contentSecurityPolicy returns the Content-Security-Policy header of the
+// frontend: the configured policy, with the API origin (if any) added to the
+// connect-src and form-action directives, for a frontend that uses the API of
+// another server (see API_URL in dashboard.js).
+func (c *config) contentSecurityPolicy() string {
+	if c.CSP == "" || c.APIOrigin == "" {
+		return c.CSP
+	}
+	directives := strings.Split(c.CSP, ";")
+	for i, directive := range directives {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), " ")
+		if name == "connect-src" || name == "form-action" {
+			directives[i] = strings.TrimRight(directive, " ") + " " + c.APIOrigin
+		}
+	}
+	return strings.Join(directives, ";")
+}
+
+// defaultConfig returns the configuration used when no options are set.
+func defaultConfig() config {
+	c := config{
+		Listen:             stringList{":8080"},
+		CSP:                defaultCSP,
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+		CacheType:          "local",
+		ShareStorage:       "firestore",
+		ShareSweepInterval: duration(time.Hour),
+		ShareIPMode:        "obfuscated",
+		AnalyticsSink:      "firestore",
+		AnalyticsMaxSize:   100 * 1000 * 1000, // 100MB
+		AnalyticsMaxFiles:  10,
+		StatsCacheTTL:      duration(10 * time.Minute),
+		MaxCacheSize:       10 * 1000 * 1000, // 10MB
+		MaxShareSize:       10 * 1024,        // 10kB max size of the JSON blob (might need to be increased in the future)
+		CompileTimeout:     duration(2 * time.Minute),
+		DrainTimeout:       duration(10 * time.Second),
+		LogLevel:           "info",
+		LogFormat:          "text",
+	}
+	if userCacheDir, err := os.UserCacheDir(); err == nil {
+		c.CacheDir = filepath.Join(userCacheDir, "tinygo-playground")
+	}
+	return c
+}
+
+// registerFlags registers a command line flag for every configuration option,
+// bound to the corresponding field in c.
+func (c *config) registerFlags(flags *flag.FlagSet) {
+	flags.Var(&c.Listen, "listen", "comma-separated list of addresses to listen on: host:port, unix:path, systemd: or systemd:name, optionally prefixed with tls:")
+	flags.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "path to the TLS certificate (reloaded on SIGHUP)")
+	flags.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "path to the TLS private key (reloaded on SIGHUP)")
+	flags.StringVar(&c.Dir, "dir", c.Dir, "which directory to serve the frontend from (default: the embedded frontend)")
+	flags.StringVar(&c.CacheDir, "cache-dir", c.CacheDir, "directory to store compiled artifacts")
+	flags.StringVar(&c.CSP, "csp", c.CSP, "Content-Security-Policy header sent with the frontend (empty to omit)")
+	flags.StringVar(&c.APIOrigin, "api-origin", c.APIOrigin, "origin of the API used by the frontend if it isn't this server, like https://example.com, allowed in the Content-Security-Policy")
+	flags.StringVar(&c.ReferrerPolicy, "referrer-policy", c.ReferrerPolicy, "Referrer-Policy header sent with the frontend (empty to omit)")
+	flags.StringVar(&c.TemplateDir, "template-dir", c.TemplateDir, "directory with the go.mod and go.sum files used for every build (default: the embedded files)")
+	flags.Var(&c.TrustedProxies, "trusted-proxies", "comma-separated list of CIDRs of reverse proxies whose Forwarded or X-Forwarded-For headers are trusted")
+	flags.IntVar(&c.ProxyHops, "proxy-hops", c.ProxyHops, "number of reverse proxies in front of the server, trusted regardless of their address (1 on Google Cloud Run)")
+	flags.StringVar(&c.CacheType, "cache-type", c.CacheType, "cache type (local, gcs)")
+	flags.StringVar(&c.BucketName, "bucket-name", c.BucketName, "Google Cloud Storage bucket name")
+	flags.StringVar(&c.FirebaseCredentials, "firebase-credentials", c.FirebaseCredentials, "path to JSON file with Firebase credentials")
+	flags.Int64Var(&c.MaxCacheSize, "max-cache-size", c.MaxCacheSize, "maximum size of the cache directory in bytes")
+	flags.Int64Var(&c.MaxShareSize, "max-share-size", c.MaxShareSize, "maximum size of a shared snippet in bytes")
+	flags.Var(&c.CompileTimeout, "compile-timeout", "maximum time to compile a single program before it is killed (0 to disable)")
+	flags.StringVar(&c.ShareStorage, "share-storage", c.ShareStorage, "where to store shared snippets (firestore, file, bolt, memory)")
+	flags.StringVar(&c.SharePath, "share-path", c.SharePath, "directory (for file) or database file (for bolt) to store shared snippets in")
+	flags.Var(&c.ShareSweepInterval, "share-sweep-interval", "how often to delete expired shared snippets (0 to disable)")
+	flags.StringVar(&c.ShareIPMode, "share-ip-mode", c.ShareIPMode, "how to store the IP address of shared snippets (obfuscated, hash, none)")
+	flags.IntVar(&c.IPRetentionDays, "ip-retention-days", c.IPRetentionDays, "number of days after which IP addresses are removed from shared snippets (0 to keep them)")
+	flags.StringVar(&c.AnalyticsSink, "analytics-sink", c.AnalyticsSink, "where to store compile tracking events (disabled, firestore, jsonl, memory)")
+	flags.StringVar(&c.AnalyticsPath, "analytics-path", c.AnalyticsPath, "file to append compile tracking events to (for jsonl)")
+	flags.Int64Var(&c.AnalyticsMaxSize, "analytics-max-size", c.AnalyticsMaxSize, "size in bytes at which the analytics file is rotated")
+	flags.IntVar(&c.AnalyticsMaxFiles, "analytics-max-files", c.AnalyticsMaxFiles, "number of rotated analytics files to keep")
+	flags.Var(&c.StatsCacheTTL, "stats-cache-ttl", "how long to cache the aggregated compile stats (0 to disable)")
+	flags.Var(&c.DrainTimeout, "drain-timeout", "time to let running requests finish on shutdown before cancelling them")
+	flags.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum log level (debug, info, warn, error)")
+	flags.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log output format (text, json)")
+	flags.StringVar(&c.GoVersion, "go-version", c.GoVersion, "Go version expected by the readiness check, for example go1.25.0")
+	flags.StringVar(&c.TinyGoVersion, "tinygo-version", c.TinyGoVersion, "TinyGo version expected by the readiness check, for example 0.39.0")
+	flags.BoolVar(&c.ReadyzSmokeTest, "readyz-smoke-test", c.ReadyzSmokeTest, "compile a small program at startup and report the result in the readiness check")
+}
+
+// loadConfig parses the command line flags and returns the resulting
+// configuration. Options are read from the defaults, the configuration file
+// (-config or $PLAYGROUND_CONFIG), environment variables and flags, where
+// later sources override earlier ones. The environment variable for an option
+// is the flag name in upper case prefixed with PLAYGROUND_, for example
+// PLAYGROUND_CACHE_DIR for -cache-dir.
+func loadConfig(flags *flag.FlagSet, args []string) (config, error) {
+	c := defaultConfig()
+	configFile := flags.String("config", os.Getenv("PLAYGROUND_CONFIG"), "path to a JSON configuration file")
+	c.registerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return c, err
+	}
+
+	// Remember the flags that were set explicitly, so they can be applied
+	// again after reading the configuration file and environment.
+	setFlags := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return c, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&c); err != nil {
+			return c, fmt.Errorf("could not parse %s: %w", *configFile, err)
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" || err != nil {
+			return
+		}
+		env := "PLAYGROUND_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid value for %s: %w", env, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+	for name, value := range setFlags {
+		flags.Lookup(name).Value.Set(value)
+	}
+
+	if c.APIOrigin != "" {
+		u, err := url.Parse(c.APIOrigin)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return c, fmt.Errorf("invalid API origin %q", c.APIOrigin)
+		}
+	}
+
+	return c, nil
+}
+
+// marshalIndent returns the configuration in the format of the configuration
+// file, so that it can be read again with -config.
+func (c *config) marshalIndent() ([]byte, error) {
+	data, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// stringList is a list of strings, set as a comma-separated list in flags and
+// environment variables.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// duration is a time.Duration that is written as a string like "10s" in JSON.
+type duration time.Duration
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(value string) error {
+	v, err := time.ParseDuration(value)
+	*d = duration(v)
+	return err
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
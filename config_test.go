@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "playground.json")
+	err := os.WriteFile(configFile, []byte(`{
+		"cacheDir": "/file",
+		"bucketName": "file",
+		"logLevel": "warn",
+		"drainTimeout": "1m"
+	}`), 0o666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PLAYGROUND_CONFIG", configFile)
+	t.Setenv("PLAYGROUND_CACHE_DIR", "/env")
+	t.Setenv("PLAYGROUND_BUCKET_NAME", "env")
+	t.Setenv("PLAYGROUND_LISTEN", "unix:/env.sock, :9000")
+
+	c, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-cache-dir=/flag", "-proxy-hops=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		option    string
+		got, want any
+	}{
+		{"cacheDir", c.CacheDir, "/flag"},   // flag over environment and file
+		{"bucketName", c.BucketName, "env"}, // environment over file
+		{"logLevel", c.LogLevel, "warn"},    // file over default
+		{"drainTimeout", c.DrainTimeout, duration(time.Minute)},
+		{"proxyHops", c.ProxyHops, 1},
+		{"listen", c.Listen.String(), "unix:/env.sock,:9000"},
+		{"logFormat", c.LogFormat, "text"}, // default
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s is %v, expected %v", tc.option, tc.got, tc.want)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "playground.json")
+	if err := os.WriteFile(configFile, []byte(`{"cacheDirectory": "/tmp"}`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", configFile}); err == nil {
+		t.Error("unknown option in the configuration file was accepted")
+	}
+
+	t.Setenv("PLAYGROUND_DRAIN_TIMEOUT", "10")
+	if _, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), nil); err == nil {
+		t.Error("invalid duration in the environment was accepted")
+	}
+}
+
+func TestConfigMarshalIndent(t *testing.T) {
+	c := defaultConfig()
+	c.Listen = stringList{"tls::443", "unix:/run/playground.sock"}
+	c.TrustedProxies = stringList{"10.0.0.0/8"}
+	c.ShareSweepInterval = duration(90 * time.Minute)
+	c.ReadyzSmokeTest = true
+	data, err := c.marshalIndent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The printed configuration can be read again as a configuration file.
+	configFile := filepath.Join(t.TempDir(), "playground.json")
+	if err := os.WriteFile(configFile, data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", configFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reprinted, err := loaded.marshalIndent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reprinted, data) {
+		t.Errorf("configuration changed after reading it back:\n%s\nexpected:\n%s", reprinted, data)
+	}
+}
+
+func TestContentSecurityPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		csp, apiOrigin, want string
+	}{
+		{defaultCSP, "", defaultCSP},
+		{"", "https://api.example.com", ""},
+		{"default-src 'self'; connect-src 'self'; form-action 'none'", "https://api.example.com",
+			"default-src 'self'; connect-src 'self' https://api.example.com; form-action 'none' https://api.example.com"},
+		{"default-src 'self'; img-src data:;", "https://api.example.com", "default-src 'self'; img-src data:;"},
+	} {
+		c := config{CSP: tc.csp, APIOrigin: tc.apiOrigin}
+		if got := c.contentSecurityPolicy(); got != tc.want {
+			t.Errorf("%q with %q:\ngot      %q\nexpected %q", tc.csp, tc.apiOrigin, got, tc.want)
+		}
+	}
+	if strings.Contains(defaultCSP, "https:") {
+		t.Errorf("default policy allows another server: %s", defaultCSP)
+	}
+
+	for _, origin := range []string{"api.example.com", "https://api.example.com/api", "ftp://example.com", "https://"} {
+		_, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-api-origin", origin})
+		if err == nil {
+			t.Errorf("invalid API origin %q was accepted", origin)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+module playground
+
+go 1.22.0
+
+require (
+	tinygo.org/x/drivers v0.27.0
+	tinygo.org/x/tinydraw v0.4.0
+	tinygo.org/x/tinyfont v0.4.0
+	tinygo.org/x/tinyfs v0.4.0
+	tinygo.org/x/tinygl-font v0.0.0-20240402104601-718d3fd5a86e
+	tinygo.org/x/tinyterm v0.3.0
+)
+
+require github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510 // indirect
@@ -6,10 +6,6 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
-	"net/http"
-	"net/netip"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -22,21 +18,22 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-const maxShareSize = 10 * 1024 // 10kB max size of the JSON blob (might need to be increased in the future)
-
 var (
 	firebaseStarted sync.Once
+	firebaseErr     error
 	firestoreClient *firestore.Client
 )
 
-func initFirebase() {
+// startFirebase connects to Firebase the first time it is called, and returns
+// the error (if any) that happened while connecting.
+func startFirebase() error {
 	firebaseStarted.Do(func() {
 		ctx := context.Background()
 		var app *firebase.App
 		var err error
-		if firebaseCredentials != "" {
+		if conf.FirebaseCredentials != "" {
 			// running locally
-			sa := option.WithCredentialsFile(firebaseCredentials)
+			sa := option.WithCredentialsFile(conf.FirebaseCredentials)
 			cfg := &firebase.Config{}
 			app, err = firebase.NewApp(ctx, cfg, sa)
 		} else {
@@ -44,209 +41,391 @@ func initFirebase() {
 			app, err = firebase.NewApp(ctx, nil)
 		}
 		if err != nil {
-			log.Fatalln(err)
+			firebaseErr = fmt.Errorf("could not initialize Firebase: %w", err)
+			return
 		}
 
 		firestoreClient, err = app.Firestore(ctx)
 		if err != nil {
-			log.Fatalln(err)
+			firebaseErr = fmt.Errorf("could not initialize Firestore: %w", err)
 		}
 	})
+	return firebaseErr
 }
 
-func handleShare(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// firestoreShareStore stores shares in the "shared" collection in Firestore.
+// It connects to Firebase on first use.
+type firestoreShareStore struct{}
 
-	if r.Method == "GET" {
-		id := r.FormValue("id")
-		if id == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("no ID supplied"))
-			return
-		}
+func (s *firestoreShareStore) Get(ctx context.Context, id string) (*share, error) {
+	if err := startFirebase(); err != nil {
+		return nil, err
+	}
+	doc, err := firestoreClient.Collection("shared").Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, errShareNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return firestoreShare(doc), nil
+}
 
-		initFirebase()
-		ctx := context.Background()
+func (s *firestoreShareStore) Create(ctx context.Context, sh *share) error {
+	if err := startFirebase(); err != nil {
+		return err
+	}
+	_, err := firestoreClient.Collection("shared").Doc(sh.ID).Create(ctx, firestoreShareDoc(sh))
+	if status.Code(err) == codes.AlreadyExists {
+		return errShareExists
+	}
+	return err
+}
 
-		doc, err := firestoreClient.Collection("shared").Doc(id).Get(ctx)
-		if status.Code(err) == codes.NotFound {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte("ID not found"))
-			return
+func (s *firestoreShareStore) Update(ctx context.Context, sh *share) error {
+	if err := startFirebase(); err != nil {
+		return err
+	}
+	ref := firestoreClient.Collection("shared").Doc(sh.ID)
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if _, err := tx.Get(ref); err != nil {
+			return err
 		}
+		return tx.Set(ref, firestoreShareDoc(sh))
+	})
+	if status.Code(err) == codes.NotFound {
+		return errShareNotFound
+	}
+	return err
+}
+
+func (s *firestoreShareStore) Delete(ctx context.Context, id string) error {
+	if err := startFirebase(); err != nil {
+		return err
+	}
+	_, err := firestoreClient.Collection("shared").Doc(id).Delete(ctx, firestore.Exists)
+	if status.Code(err) == codes.NotFound {
+		return errShareNotFound
+	}
+	return err
+}
+
+func (s *firestoreShareStore) Modify(ctx context.Context, id string, fn func(*share) (*share, error)) error {
+	if err := startFirebase(); err != nil {
+		return err
+	}
+	ref := firestoreClient.Collection("shared").Doc(id)
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("could not fetch shared data"))
-			fmt.Fprintln(os.Stderr, "could not fetch data:", err)
-			return
+			return err
 		}
-		data, err := json.Marshal(map[string]any{
-			"data": doc.Data()["data"],
-		})
+		sh, err := fn(firestoreShare(doc))
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("could not serialize shared data"))
-			fmt.Fprintln(os.Stderr, "could not serialize data:", err)
-			return
+			return err
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(data)
-	} else if r.Method == "POST" {
-		if r.Header.Get("Content-Type") != "application/json" {
-			w.WriteHeader(http.StatusUnsupportedMediaType)
-			w.Write([]byte("expected application/json data"))
-			return
+		if sh == nil {
+			return tx.Delete(ref)
 		}
+		return tx.Set(ref, firestoreShareDoc(sh))
+	})
+	if status.Code(err) == codes.NotFound {
+		return errShareNotFound
+	}
+	return err
+}
 
-		// Read the data from the POST request.
-		var data any
-		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxShareSize)).Decode(&data)
+func (s *firestoreShareStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := startFirebase(); err != nil {
+		return 0, err
+	}
+	iter := firestoreClient.Collection("shared").Where("expires", "<=", now).Documents(ctx)
+	defer iter.Stop()
+	n := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return n, nil
+		}
 		if err != nil {
-			w.WriteHeader(http.StatusUnprocessableEntity)
-			w.Write([]byte("could not parse JSON"))
-			return
+			return n, err
 		}
-
-		initFirebase()
-		ctx := context.Background()
-
-		// Use a RFC3339 formatted timestamp, rounded to a single minute.
-		timestamp := time.Now().UTC().Round(time.Minute)
-
-		// Read IP address, but make it less precise.
-		obfuscatedIP, err := getObfuscatedIP(r)
+		_, err = doc.Ref.Delete(ctx)
 		if err != nil {
-			log.Fatalln(err)
+			return n, err
 		}
+		n++
+	}
+}
 
-		ref, _, err := firestoreClient.Collection("shared").Add(ctx, map[string]interface{}{
-			"time": timestamp,
-			"ip":   obfuscatedIP,
-			"data": data,
-		})
+// StripIPs only reads the shares that still have an IP address and are older
+// than the retention period. The query needs a composite index on ip and time.
+func (s *firestoreShareStore) StripIPs(ctx context.Context, before time.Time) (int, error) {
+	if err := startFirebase(); err != nil {
+		return 0, err
+	}
+	iter := firestoreClient.Collection("shared").Where("ip", ">", "").Where("time", "<", before).Documents(ctx)
+	defer iter.Stop()
+	n := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return n, nil
+		}
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("could not store data"))
-			fmt.Fprintln(os.Stderr, "could not store data:", err)
-			return
+			return n, err
 		}
-
-		// Return a JSON object. Not because we need it right now (we're just
-		// returning an ID), but it makes the API extensible in the future.
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"id": ref.ID,
-		})
+		_, err = doc.Ref.Update(ctx, []firestore.Update{{Path: "ip", Value: ""}})
+		if err != nil {
+			return n, err
+		}
+		n++
 	}
 }
 
-// Obtain an obfuscated IP address, with the last bits removed to preserve
-// privacy.
-func getObfuscatedIP(r *http.Request) (string, error) {
-	var address netip.Addr
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		// Running inside Google Cloud Run (or behind a reverse proxy anyway).
-		// Parse the last IP address in the comma-separated list, because that's
-		// the one that's added by Google Cloud Run.
-		parts := strings.Split(forwarded, ",")
-		var err error
-		address, err = netip.ParseAddr(strings.TrimSpace(parts[len(parts)-1]))
-		if err != nil {
-			return "", fmt.Errorf("could not parse X-Forwarded-For header: %w", err)
+func (s *firestoreShareStore) List(ctx context.Context, fn func(*share) error) error {
+	if err := startFirebase(); err != nil {
+		return err
+	}
+	iter := firestoreClient.Collection("shared").Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
 		}
-	} else {
-		// Running locally.
-		addrport, err := netip.ParseAddrPort(r.RemoteAddr)
 		if err != nil {
-			return "", fmt.Errorf("could not parse r.RemoteAddr: %w", err)
+			return err
+		}
+		if err := fn(firestoreShare(doc)); err != nil {
+			return err
 		}
-		address = addrport.Addr()
 	}
-	if address.Is4() {
-		// clear last octet
-		ip := address.As4()
-		ip[3] = 0
-		return netip.AddrFrom4(ip).String() + "/24", nil
-	} else { // IPv6
-		// Zero all but the first 3 octets, to make it a /48 address.
-		// We might want to consider redacting the address a bit more, since
-		// this still identifies a single ISP customer.
-		ip := address.As16()
-		for i := 6; i < 16; i++ {
-			ip[i] = 0
+}
+
+func (s *firestoreShareStore) Forks(ctx context.Context, parent string) ([]*share, error) {
+	if err := startFirebase(); err != nil {
+		return nil, err
+	}
+	iter := firestoreClient.Collection("shared").Where("parent", "==", parent).Documents(ctx)
+	defer iter.Stop()
+	var forks []*share
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return forks, nil
 		}
-		return netip.AddrFrom16(ip).String() + "/48", nil
+		if err != nil {
+			return nil, err
+		}
+		forks = append(forks, firestoreShare(doc))
 	}
 }
 
-// Track a single compiler action.
-func trackCompile(data map[string]any, modified string) {
-	initFirebase()
-	ctx := context.Background()
+func (s *firestoreShareStore) Close() error {
+	return nil
+}
 
-	// Calculate ID for this data point.
-	buf, err := json.Marshal(data)
-	if err != nil {
-		log.Println("ERROR: could not marshal tracking data:", err)
-		return
-	}
-	hash := sha256.Sum256(buf)
-	id := base64.URLEncoding.EncodeToString(hash[:])[:20] // same length as standard IDs
-
-	// Add to the right counter. We track initial (unmodified) and modified
-	// buffers separately.
-	switch modified {
-	case "false":
-		data["count_initial"] = firestore.Increment(1)
-		data["count_modified"] = firestore.Increment(0)
-	case "true":
-		data["count_initial"] = firestore.Increment(0)
-		data["count_modified"] = firestore.Increment(1)
-	default:
-		// No valid "modified" parameter given, so can't track.
-		return
-	}
-
-	_, err = firestoreClient.Collection("track").Doc(id).Set(ctx, data, firestore.MergeAll)
-	if err != nil {
-		log.Printf("tracker: %s", err)
+// firestoreShareDoc converts a share to a document in the "shared"
+// collection.
+func firestoreShareDoc(sh *share) map[string]interface{} {
+	doc := map[string]interface{}{
+		"time":     sh.Time,
+		"ip":       sh.IP,
+		"data":     sh.Data,
+		"revision": sh.Revision,
+	}
+	if sh.Parent != "" {
+		doc["parent"] = sh.Parent
+	}
+	if len(sh.OwnerHashes) != 0 {
+		doc["ownerHashes"] = sh.OwnerHashes
+	}
+	if sh.Expires != nil {
+		doc["expires"] = *sh.Expires
+	}
+	return doc
+}
+
+// firestoreShare converts a document in the "shared" collection to a share.
+func firestoreShare(doc *firestore.DocumentSnapshot) *share {
+	data := doc.Data()
+	sh := &share{
+		ID:   doc.Ref.ID,
+		Data: data["data"],
 	}
+	sh.Time, _ = data["time"].(time.Time)
+	sh.IP, _ = data["ip"].(string)
+	sh.Parent, _ = data["parent"].(string)
+	if owners, ok := data["ownerHashes"].([]interface{}); ok {
+		for _, owner := range owners {
+			hash, _ := owner.(string)
+			sh.OwnerHashes = append(sh.OwnerHashes, hash)
+		}
+	}
+	if expires, ok := data["expires"].(time.Time); ok {
+		sh.Expires = &expires
+	}
+	if revision, ok := data["revision"].(int64); ok {
+		sh.Revision = int(revision)
+	}
+	return sh
 }
 
-// Return recent compilation stats.
-func getStats(w http.ResponseWriter, r *http.Request) {
-	initFirebase()
-	ctx := context.Background()
+// firestoreAnalytics stores compile events as counters in the "track"
+// collection in Firestore, with one document per day and combination of page,
+// compiler, target and flashFirmware. The other details of a compileEvent are
+// counted in the "details" map of these documents, keyed by
+// firestoreDetailsKey, so that they don't multiply the number of documents.
+// The map is never queried, so it can be exempted from indexing.
+type firestoreAnalytics struct{}
 
-	// Allow access from everywhere.
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+func (firestoreAnalytics) Write(ctx context.Context, events []compileEvent) error {
+	if err := startFirebase(); err != nil {
+		return err
+	}
 
-	// Query data of the past 30 days.
-	const numDays = 30
-	now := time.Now().UTC().Truncate(time.Hour * 24)
-	start := now.Add(-time.Hour * 24 * numDays)
-	end := now
-	iter := firestoreClient.Collection("track").Where("timestamp", ">=", start).Where("timestamp", "<", end).Documents(ctx)
+	// Sum the events per document, so that each document is only written
+	// once per batch.
+	type counter struct {
+		data     map[string]any
+		initial  int
+		modified int
+		details  map[string]*[2]int // initial and modified, by firestoreDetailsKey
+	}
+	counters := make(map[string]*counter)
+	for _, event := range events {
+		data := map[string]any{
+			"page":          event.Page,
+			"compiler":      event.Compiler,
+			"target":        event.Target,
+			"flashFirmware": event.FlashFirmware,
+			"timestamp":     event.Time.UTC().Truncate(time.Hour * 24),
+		}
+
+		// Calculate ID for this data point.
+		buf, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(buf)
+		id := base64.URLEncoding.EncodeToString(hash[:])[:20] // same length as standard IDs
+
+		c := counters[id]
+		if c == nil {
+			c = &counter{data: data, details: make(map[string]*[2]int)}
+			counters[id] = c
+		}
+		point := event.trackPoint()
+		key := firestoreDetailsKey(&point)
+		if key != "" && c.details[key] == nil {
+			c.details[key] = &[2]int{}
+		}
+		// We track initial (unmodified) and modified buffers separately.
+		if event.Modified {
+			c.modified++
+			if key != "" {
+				c.details[key][1]++
+			}
+		} else {
+			c.initial++
+			if key != "" {
+				c.details[key][0]++
+			}
+		}
+	}
+
+	for id, c := range counters {
+		c.data["count_initial"] = firestore.Increment(c.initial)
+		c.data["count_modified"] = firestore.Increment(c.modified)
+		if len(c.details) != 0 {
+			details := make(map[string]any)
+			for key, counts := range c.details {
+				details[key] = map[string]any{
+					"initial":  firestore.Increment(counts[0]),
+					"modified": firestore.Increment(counts[1]),
+				}
+			}
+			c.data["details"] = details
+		}
+		_, err := firestoreClient.Collection("track").Doc(id).Set(ctx, c.data, firestore.MergeAll)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (firestoreAnalytics) Query(ctx context.Context, from, to time.Time) ([]trackPoint, error) {
+	if err := startFirebase(); err != nil {
+		return nil, err
+	}
+	iter := firestoreClient.Collection("track").Where("timestamp", ">=", from).Where("timestamp", "<", to).Documents(ctx)
 	defer iter.Stop()
 
-	// Request all data.
-	allData := []map[string]any{}
+	var points []trackPoint
 	for {
 		doc, err := iter.Next()
 		if err == iterator.Done {
-			break
+			return points, nil
 		}
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("could not fetch stats data"))
-			fmt.Fprintln(os.Stderr, "could not fetch data:", err)
-			return
+			return nil, err
+		}
+		data := doc.Data()
+		var point trackPoint
+		point.Day, _ = data["timestamp"].(time.Time)
+		point.Page, _ = data["page"].(string)
+		point.Compiler, _ = data["compiler"].(string)
+		point.Target, _ = data["target"].(string)
+		point.FlashFirmware, _ = data["flashFirmware"].(bool)
+		point.Initial, _ = data["count_initial"].(int64)
+		point.Modified, _ = data["count_modified"].(int64)
+
+		// Split the counts by details. What remains are the compiles that
+		// were tracked before compiles had details.
+		details, _ := data["details"].(map[string]any)
+		for key, value := range details {
+			counts, _ := value.(map[string]any)
+			detailed := point
+			if !detailed.setFirestoreDetails(key) {
+				continue
+			}
+			detailed.Initial, _ = counts["initial"].(int64)
+			detailed.Modified, _ = counts["modified"].(int64)
+			point.Initial -= detailed.Initial
+			point.Modified -= detailed.Modified
+			points = append(points, detailed)
+		}
+		if point.Initial != 0 || point.Modified != 0 {
+			points = append(points, point)
 		}
-		allData = append(allData, doc.Data())
 	}
+}
+
+// firestoreDetailsKey returns the details of the point that aren't part of the
+// document ID in the "track" collection, as a key in the "details" map of the
+// document. It returns "" if the point has no details.
+func firestoreDetailsKey(p *trackPoint) string {
+	details := []string{p.Outcome, p.QueueBucket, p.BuildBucket, p.CacheTier, p.ToolchainVersion, p.ErrorClass}
+	if strings.Join(details, "") == "" {
+		return ""
+	}
+	key, _ := json.Marshal(details)
+	return string(key)
+}
+
+// setFirestoreDetails sets the details of the point from a key returned by
+// firestoreDetailsKey, and reports whether the key was valid.
+func (p *trackPoint) setFirestoreDetails(key string) bool {
+	var details []string
+	if err := json.Unmarshal([]byte(key), &details); err != nil || len(details) != 6 {
+		return false
+	}
+	p.Outcome, p.QueueBucket, p.BuildBucket, p.CacheTier, p.ToolchainVersion, p.ErrorClass = details[0], details[1], details[2], details[3], details[4], details[5]
+	return true
+}
 
-	// Send the data to the client.
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(allData)
+func (firestoreAnalytics) Close() error {
+	return nil
 }
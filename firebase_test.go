@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestFirestoreDetailsKey(t *testing.T) {
+	if key := firestoreDetailsKey(&trackPoint{Target: "wasm", Initial: 1}); key != "" {
+		t.Errorf("point without details has key %q", key)
+	}
+
+	point := trackPoint{
+		Outcome:          "compile-error",
+		QueueBucket:      "<1s",
+		BuildBucket:      "1-5s",
+		CacheTier:        "build",
+		ToolchainVersion: "go1.22.0",
+		ErrorClass:       "syntax",
+	}
+	key := firestoreDetailsKey(&point)
+	var parsed trackPoint
+	if !parsed.setFirestoreDetails(key) || parsed != point {
+		t.Errorf("key %q parsed as %+v, expected %+v", key, parsed, point)
+	}
+
+	for _, key := range []string{"", "outcome", `["success"]`, `["a","b","c","d","e","f","g"]`} {
+		if (&trackPoint{}).setFirestoreDetails(key) {
+			t.Errorf("invalid key %q was accepted", key)
+		}
+	}
+}
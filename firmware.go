@@ -0,0 +1,292 @@
+package main
+
+// This file implements converting firmware built by TinyGo as an ELF file to
+// the other firmware formats, so that a program only needs to be built once
+// for all of them.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sections of a flat binary (bin, hex and uf2) are padded if there is a gap
+// between them, but a larger gap likely means the sections are in different
+// memories, which can't be written as a single image. This is the same limit
+// TinyGo uses.
+const firmwareMaxPadding = 4095
+
+// Constants of the UF2 format, see https://github.com/microsoft/uf2.
+const (
+	uf2Magic0         = 0x0A324655
+	uf2Magic1         = 0x9E5D5157
+	uf2MagicEnd       = 0x0AB16F30
+	uf2FlagFamilyID   = 0x00002000
+	uf2BlockSize      = 512
+	uf2PayloadSize    = 256 // the maximum is 476, but bootloaders expect 256
+	uf2DataOffset     = 32
+	uf2MagicEndOffset = uf2BlockSize - 4
+)
+
+// Modification time of the files in a firmware bundle. It is fixed so that the
+// bundle only depends on the firmware.
+var firmwareBundleTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// firmwareImage is the contents of the flash memory of a board, as read from
+// the sections of an ELF file.
+type firmwareImage struct {
+	Segments []firmwareSegment // sorted by address
+}
+
+// firmwareSegment is a contiguous piece of a firmwareImage.
+type firmwareSegment struct {
+	Addr uint64 // physical (load) address
+	Data []byte
+}
+
+// readFirmwareImage reads the sections that are stored in flash from the ELF
+// file, like "objcopy -O binary" does: every allocated section with contents
+// is placed at its load address. Which segments exist and where they start in
+// the file is up to the linker, so the ELF and program headers are never
+// mistaken for firmware.
+func readFirmwareImage(f *elf.File) (*firmwareImage, error) {
+	img := &firmwareImage{}
+	for _, section := range f.Sections {
+		if section.Flags&elf.SHF_ALLOC == 0 || section.Type == elf.SHT_NOBITS || section.Size == 0 {
+			continue
+		}
+		data, err := section.Data()
+		if err != nil {
+			return nil, fmt.Errorf("could not read section %s: %w", section.Name, err)
+		}
+		img.Segments = append(img.Segments, firmwareSegment{sectionLoadAddr(f, section), data})
+	}
+	if len(img.Segments) == 0 {
+		return nil, fmt.Errorf("firmware has no loadable sections")
+	}
+	sort.SliceStable(img.Segments, func(i, j int) bool {
+		return img.Segments[i].Addr < img.Segments[j].Addr
+	})
+	return img, nil
+}
+
+// sectionLoadAddr returns the address the section is loaded from. The section
+// header only has the address the section is used at, which for initialized
+// data is in RAM. The loadable segment that contains the section in the file
+// has both, and its physical address is the address in flash.
+func sectionLoadAddr(f *elf.File, section *elf.Section) uint64 {
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD && section.Addr >= prog.Vaddr && section.Addr+section.Size <= prog.Vaddr+prog.Filesz {
+			return prog.Paddr + (section.Addr - prog.Vaddr)
+		}
+	}
+	return section.Addr
+}
+
+// flatten returns the image as a single block of memory starting at the
+// returned address, with the gaps between segments filled with zeroes.
+func (img *firmwareImage) flatten() (uint64, []byte, error) {
+	start := img.Segments[0].Addr
+	var data []byte
+	for _, segment := range img.Segments {
+		end := start + uint64(len(data))
+		if segment.Addr < end {
+			return 0, nil, fmt.Errorf("firmware segments overlap at address 0x%x", segment.Addr)
+		}
+		if segment.Addr-end > firmwareMaxPadding {
+			return 0, nil, fmt.Errorf("firmware segments are not contiguous: gap from 0x%x to 0x%x", end, segment.Addr)
+		}
+		data = append(data, make([]byte, segment.Addr-end)...)
+		data = append(data, segment.Data...)
+	}
+	return start, data, nil
+}
+
+// firmwareBin returns the image as a raw binary, like "objcopy -O binary".
+func firmwareBin(img *firmwareImage) ([]byte, error) {
+	_, data, err := img.flatten()
+	return data, err
+}
+
+// firmwareHex returns the image in the Intel HEX format, with 16 bytes per
+// data record. Like the hex files of TinyGo, it has no start address record:
+// the bootloader or the reset vector decides where to start.
+func firmwareHex(img *firmwareImage) ([]byte, error) {
+	start, data, err := img.flatten()
+	if err != nil {
+		return nil, err
+	}
+	if start+uint64(len(data)) > 1<<32 {
+		return nil, fmt.Errorf("firmware at 0x%x does not fit in 32-bit addresses", start)
+	}
+	buf := &bytes.Buffer{}
+	record := func(addr uint16, kind byte, data []byte) {
+		sum := byte(len(data)) + byte(addr>>8) + byte(addr) + kind
+		fmt.Fprintf(buf, ":%02X%04X%02X", len(data), addr, kind)
+		for _, b := range data {
+			fmt.Fprintf(buf, "%02X", b)
+			sum += b
+		}
+		fmt.Fprintf(buf, "%02X\n", -sum)
+	}
+	upper := uint64(0) // upper 16 bits of the address of the data records
+	for offset := 0; offset < len(data); {
+		addr := start + uint64(offset)
+		if addr>>16 != upper {
+			upper = addr >> 16
+			record(0, 0x04, binary.BigEndian.AppendUint16(nil, uint16(upper))) // extended linear address
+		}
+		// Don't cross a 64KiB boundary within a record.
+		n := min(16, len(data)-offset, int(0x10000-addr&0xffff))
+		record(uint16(addr), 0x00, data[offset:offset+n])
+		offset += n
+	}
+	record(0, 0x01, nil) // end of file
+	return buf.Bytes(), nil
+}
+
+// firmwareUF2 returns the image in the UF2 format, for bootloaders that
+// present the board as a USB drive. The family ID identifies the chip, so that
+// bootloaders reject firmware for a different chip.
+func firmwareUF2(img *firmwareImage, familyID uint32) ([]byte, error) {
+	start, data, err := img.flatten()
+	if err != nil {
+		return nil, err
+	}
+	// Bootloaders write whole flash pages, so start at a payload boundary.
+	align := start % uf2PayloadSize
+	start -= align
+	data = append(make([]byte, align), data...)
+	if start+uint64(len(data)) > 1<<32 {
+		return nil, fmt.Errorf("firmware at 0x%x does not fit in 32-bit addresses", start)
+	}
+
+	numBlocks := (len(data) + uf2PayloadSize - 1) / uf2PayloadSize
+	out := make([]byte, 0, numBlocks*uf2BlockSize)
+	for i := 0; i < numBlocks; i++ {
+		block := make([]byte, uf2BlockSize)
+		binary.LittleEndian.PutUint32(block[0:], uf2Magic0)
+		binary.LittleEndian.PutUint32(block[4:], uf2Magic1)
+		binary.LittleEndian.PutUint32(block[8:], uf2FlagFamilyID)
+		binary.LittleEndian.PutUint32(block[12:], uint32(start)+uint32(i*uf2PayloadSize))
+		binary.LittleEndian.PutUint32(block[16:], uf2PayloadSize)
+		binary.LittleEndian.PutUint32(block[20:], uint32(i))
+		binary.LittleEndian.PutUint32(block[24:], uint32(numBlocks))
+		binary.LittleEndian.PutUint32(block[28:], familyID)
+		copy(block[uf2DataOffset:uf2DataOffset+uf2PayloadSize], data[i*uf2PayloadSize:])
+		binary.LittleEndian.PutUint32(block[uf2MagicEndOffset:], uf2MagicEnd)
+		out = append(out, block...)
+	}
+	return out, nil
+}
+
+// firmwareSymbols returns a listing of the allocated sections of the firmware
+// and the symbols in them, sorted by address, generated from the ELF file.
+// It is not a linker map: TinyGo doesn't pass linker flags through, so there
+// is no way to ask for one.
+func firmwareSymbols(f *elf.File) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Sections:\n%-10s %-10s %s\n", "Address", "Size", "Name")
+	for _, section := range f.Sections {
+		if section.Flags&elf.SHF_ALLOC == 0 || section.Size == 0 {
+			continue
+		}
+		fmt.Fprintf(buf, "0x%08x 0x%08x %s\n", section.Addr, section.Size, section.Name)
+	}
+
+	symbols, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+	symbols = slices.DeleteFunc(symbols, func(sym elf.Symbol) bool {
+		typ := elf.ST_TYPE(sym.Info)
+		return sym.Name == "" || sym.Size == 0 || int(sym.Section) >= len(f.Sections) || (typ != elf.STT_FUNC && typ != elf.STT_OBJECT)
+	})
+	sort.SliceStable(symbols, func(i, j int) bool {
+		if symbols[i].Value != symbols[j].Value {
+			return symbols[i].Value < symbols[j].Value
+		}
+		return symbols[i].Name < symbols[j].Name
+	})
+	fmt.Fprintf(buf, "\nSymbols:\n%-10s %-10s %-16s %s\n", "Address", "Size", "Section", "Name")
+	for _, sym := range symbols {
+		fmt.Fprintf(buf, "0x%08x 0x%08x %-16s %s\n", sym.Value, sym.Size, f.Sections[sym.Section].Name, sym.Name)
+	}
+	return buf.Bytes(), nil
+}
+
+// firmwareBundle returns a zip file with the firmware in all formats the board
+// supports, a symbol listing, and a SHA256SUMS file with the checksums of all
+// other files in the format of sha256sum.
+func firmwareBundle(elfData []byte, f *elf.File, img *firmwareImage, board *partDefinition) ([]byte, error) {
+	files := []exportFile{{"firmware.elf", elfData}}
+	hex, err := firmwareHex(img)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, exportFile{"firmware.hex", hex})
+	if board.UF2FamilyID != "" {
+		familyID, err := board.uf2FamilyID()
+		if err != nil {
+			return nil, err
+		}
+		uf2, err := firmwareUF2(img, familyID)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, exportFile{"firmware.uf2", uf2})
+	}
+	symbols, err := firmwareSymbols(f)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, exportFile{"firmware.symbols.txt", symbols})
+
+	sums := &strings.Builder{}
+	for _, file := range files {
+		fmt.Fprintf(sums, "%x  %s\n", sha256.Sum256(file.Data), file.Name)
+	}
+	files = append(files, exportFile{"SHA256SUMS", []byte(sums.String())})
+	return exportZip(board.Name+"-firmware", files, firmwareBundleTime)
+}
+
+// convertFirmware converts the ELF file at the given path to the given
+// firmware format for the board.
+func convertFirmware(elfPath, format string, board *partDefinition) ([]byte, error) {
+	elfData, err := os.ReadFile(elfPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := elf.NewFile(bytes.NewReader(elfData))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := readFirmwareImage(f)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "bin":
+		return firmwareBin(img)
+	case "hex":
+		return firmwareHex(img)
+	case "uf2":
+		familyID, err := board.uf2FamilyID()
+		if err != nil {
+			return nil, err
+		}
+		return firmwareUF2(img, familyID)
+	case "bundle":
+		return firmwareBundle(elfData, f, img, board)
+	default:
+		return nil, fmt.Errorf("cannot convert firmware to format %q", format)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The ELF files in testdata/firmware are linked from the assembly files next
+// to them with the linker scripts of TinyGo 0.33 (GNU ld, elf_i386: the
+// conversion doesn't depend on the architecture):
+//
+//	pico.elf: targets/rp2040.ld with --defsym=__flash_size=2048K
+//	uno.elf:  atmega328p.ld (which includes targets/avr.ld) with
+//	          --defsym=_bootloader_size=512 --defsym=_stack_size=512
+//	hdr.elf:  hdr.ld, which puts the ELF headers and the code in the same
+//	          segment, at file offset 0
+//
+// The bin, hex and uf2 files were created from them by the objcopy.go and
+// uf2.go of TinyGo 0.33, except hdr.bin which was created by
+// "objcopy -O binary" as TinyGo drops the code in that layout.
+
+func TestConvertFirmware(t *testing.T) {
+	for _, tc := range []struct {
+		elf, format string
+		board       partDefinition
+	}{
+		{"pico.elf", "bin", partDefinition{Name: "pico"}},
+		{"pico.elf", "hex", partDefinition{Name: "pico"}},
+		{"pico.elf", "uf2", partDefinition{Name: "pico", UF2FamilyID: "0xe48bff56"}},
+		{"uno.elf", "bin", partDefinition{Name: "arduino"}},
+		{"uno.elf", "hex", partDefinition{Name: "arduino"}},
+		{"hdr.elf", "bin", partDefinition{Name: "hdr"}},
+	} {
+		t.Run(tc.elf+"/"+tc.format, func(t *testing.T) {
+			elfPath := filepath.Join("testdata", "firmware", tc.elf)
+			want, err := os.ReadFile(strings.TrimSuffix(elfPath, ".elf") + "." + tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := convertFirmware(elfPath, tc.format, &tc.board)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from known-good output: got %d bytes, expected %d bytes", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestReadFirmwareImage(t *testing.T) {
+	f, err := elf.Open(filepath.Join("testdata", "firmware", "uno.elf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := readFirmwareImage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The code at the start of flash, then the initialized data, which is
+	// used at 0x800300 in RAM but stored in flash right after the code.
+	if len(img.Segments) != 2 || img.Segments[0].Addr != 0 || len(img.Segments[0].Data) != 0x140 ||
+		img.Segments[1].Addr != 0x140 || !bytes.HasPrefix(img.Segments[1].Data, []byte("hello, uno\x00")) {
+		t.Errorf("unexpected segments: %+v", img.Segments)
+	}
+}
+
+func TestFirmwareFlatten(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		segments []firmwareSegment
+		start    uint64
+		data     []byte
+		err      string
+	}{
+		{"single", []firmwareSegment{{0x100, []byte{1, 2}}}, 0x100, []byte{1, 2}, ""},
+		{"contiguous", []firmwareSegment{{0x100, []byte{1, 2}}, {0x102, []byte{3}}}, 0x100, []byte{1, 2, 3}, ""},
+		{"gap", []firmwareSegment{{0x100, []byte{1}}, {0x104, []byte{2}}}, 0x100, []byte{1, 0, 0, 0, 2}, ""},
+		{"largest gap", []firmwareSegment{{0, []byte{1}}, {1 + firmwareMaxPadding, []byte{2}}}, 0, append(append([]byte{1}, make([]byte, firmwareMaxPadding)...), 2), ""},
+		{"gap too large", []firmwareSegment{{0, []byte{1}}, {2 + firmwareMaxPadding, []byte{2}}}, 0, nil, "not contiguous: gap from 0x1 to 0x1001"},
+		{"overlap", []firmwareSegment{{0x100, []byte{1, 2}}, {0x101, []byte{3}}}, 0, nil, "overlap at address 0x101"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := &firmwareImage{Segments: tc.segments}
+			start, data, err := img.flatten()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("got error %v, expected %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if start != tc.start || !bytes.Equal(data, tc.data) {
+				t.Errorf("got 0x%x %x, expected 0x%x %x", start, data, tc.start, tc.data)
+			}
+		})
+	}
+}
+
+func TestFirmwareHex(t *testing.T) {
+	counting := make([]byte, 20)
+	for i := range counting {
+		counting[i] = byte(i)
+	}
+	// The expected output is what TinyGo writes with gohex.
+	for _, tc := range []struct {
+		name     string
+		segments []firmwareSegment
+		hex      string
+	}{
+		{
+			// The example of https://en.wikipedia.org/wiki/Intel_HEX.
+			"data records",
+			[]firmwareSegment{{0x100, []byte{0x21, 0x46, 0x01, 0x36, 0x01, 0x21, 0x47, 0x01, 0x36, 0x00, 0x7E, 0xFE, 0x09, 0xD2, 0x19, 0x01, 0xff, 0x00}}},
+			":10010000214601360121470136007EFE09D2190140\n" +
+				":02011000FF00EE\n" +
+				":00000001FF\n",
+		},
+		{
+			"extended address across 64KiB",
+			[]firmwareSegment{{0x0800FFF8, counting}},
+			":020000040800F2\n" +
+				":08FFF8000001020304050607E5\n" +
+				":020000040801F1\n" +
+				":0C00000008090A0B0C0D0E0F1011121352\n" +
+				":00000001FF\n",
+		},
+		{
+			"padded gap",
+			[]firmwareSegment{{0x10000000, []byte{1, 2, 3}}, {0x10000014, []byte{4, 5}}},
+			":020000041000EA\n" +
+				":1000000001020300000000000000000000000000EA\n" +
+				":06001000000000000405E1\n" +
+				":00000001FF\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hex, err := firmwareHex(&firmwareImage{Segments: tc.segments})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(hex) != tc.hex {
+				t.Errorf("got:\n%s\nexpected:\n%s", hex, tc.hex)
+			}
+		})
+	}
+
+	if _, err := firmwareHex(&firmwareImage{Segments: []firmwareSegment{{0xFFFFFFFF, []byte{1, 2}}}}); err == nil {
+		t.Error("expected an error for firmware above 4GiB")
+	}
+}
+
+func TestFirmwareUF2(t *testing.T) {
+	const familyID = 0xe48bff56
+	data := make([]byte, 600)
+	for i := range data {
+		data[i] = byte(i%251) + 1
+	}
+	for _, tc := range []struct {
+		name  string
+		addr  uint64
+		start uint32 // address of the first block
+		pad   int    // zero bytes before the data in the first block
+	}{
+		{"aligned", 0x10000000, 0x10000000, 0},
+		{"unaligned", 0x10000010, 0x10000000, 16},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := firmwareUF2(&firmwareImage{Segments: []firmwareSegment{{tc.addr, data}}}, familyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := append(make([]byte, tc.pad), data...)
+			numBlocks := (len(payload) + uf2PayloadSize - 1) / uf2PayloadSize
+			if len(out) != numBlocks*uf2BlockSize {
+				t.Fatalf("got %d bytes, expected %d blocks", len(out), numBlocks)
+			}
+			for i := 0; i < numBlocks; i++ {
+				block := out[i*uf2BlockSize : (i+1)*uf2BlockSize]
+				header := make([]uint32, 8)
+				binary.Read(bytes.NewReader(block), binary.LittleEndian, header)
+				want := []uint32{uf2Magic0, uf2Magic1, uf2FlagFamilyID, tc.start + uint32(i*uf2PayloadSize), uf2PayloadSize, uint32(i), uint32(numBlocks), familyID}
+				for j := range want {
+					if header[j] != want[j] {
+						t.Errorf("block %d: header word %d is 0x%x, expected 0x%x", i, j, header[j], want[j])
+					}
+				}
+				chunk := payload[i*uf2PayloadSize : min((i+1)*uf2PayloadSize, len(payload))]
+				wantData := make([]byte, uf2MagicEndOffset-uf2DataOffset)
+				copy(wantData, chunk)
+				if !bytes.Equal(block[uf2DataOffset:uf2MagicEndOffset], wantData) {
+					t.Errorf("block %d: unexpected data", i)
+				}
+				if end := binary.LittleEndian.Uint32(block[uf2MagicEndOffset:]); end != uf2MagicEnd {
+					t.Errorf("block %d: end magic is 0x%x", i, end)
+				}
+			}
+		})
+	}
+}
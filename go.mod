@@ -1,11 +1,13 @@
 module github.com/tinygo-org/playground
 
-go 1.21
+go 1.22
 
 require (
 	cloud.google.com/go/firestore v1.16.0
 	cloud.google.com/go/storage v1.43.0
 	firebase.google.com/go v3.13.0+incompatible
+	github.com/andybalholm/brotli v1.1.1
+	go.etcd.io/bbolt v1.3.11
 	google.golang.org/api v0.196.0
 	google.golang.org/grpc v1.66.0
 )
@@ -0,0 +1,229 @@
+package main
+
+// This file implements the health and readiness endpoints, used by the
+// orchestrator to decide whether an instance can take traffic.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+// Maximum time the readiness checks may take together.
+const readinessTimeout = 30 * time.Second
+
+// Program compiled by the smoke test.
+const smokeTestSource = "package main\n\nfunc main() {\n}\n"
+
+// smokeTest is the result of the smoke test, which is run once at startup so
+// that readiness probes don't take up the compile queue.
+var smokeTest struct {
+	lock   sync.Mutex
+	done   bool
+	detail string
+	err    error
+}
+
+// checkResult is the result of a single readiness check, as reported in JSON.
+type checkResult struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readinessCheck returns details about a working dependency, or an error if
+// the dependency isn't working.
+type readinessCheck func(ctx context.Context) (string, error)
+
+// handleHealthz handles the /healthz endpoint. It only reports that the
+// process is alive and serving HTTP requests.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+	})
+}
+
+// handleReadyz handles the /readyz endpoint. It checks all dependencies
+// needed to serve requests, and reports the result of each check as JSON.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if draining.Load() {
+		// Don't send new traffic to an instance that is shutting down.
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]any{
+			"status": "draining",
+		})
+		return
+	}
+
+	checks := map[string]readinessCheck{
+		"go":       checkVersion("go", conf.GoVersion),
+		"tinygo":   checkVersion("tinygo", conf.TinyGoVersion),
+		"cache":    checkCacheDir,
+		"template": checkTemplate,
+	}
+	if conf.ShareStorage == "firestore" || conf.AnalyticsSink == "firestore" {
+		checks["firebase"] = checkFirestore
+	}
+	if bucket != nil {
+		checks["gcs"] = checkBucket
+	}
+	if conf.ReadyzSmokeTest {
+		checks["smoke-test"] = checkSmokeTest
+	}
+
+	// Run all checks in parallel.
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	results := make(map[string]checkResult)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			detail, err := check(ctx)
+			result := checkResult{OK: err == nil, Detail: detail}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			lock.Lock()
+			results[name] = result
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	status := "ok"
+	for name, result := range results {
+		if !result.OK {
+			status = "fail"
+			logger(r.Context()).Warn("readiness check failed", "check", name, "err", result.Error)
+		}
+	}
+	if status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": status,
+		"checks": results,
+	})
+}
+
+// checkVersion returns a check that runs "<command> version" and verifies that
+// the output contains the expected version string.
+func checkVersion(command, expected string) readinessCheck {
+	return func(ctx context.Context) (string, error) {
+		out, err := exec.CommandContext(ctx, command, "version").CombinedOutput()
+		version := strings.TrimSpace(string(out))
+		if err != nil {
+			return version, fmt.Errorf("could not run %s: %w", command, err)
+		}
+		if expected != "" && !strings.Contains(version, expected) {
+			return version, fmt.Errorf("expected version %s", expected)
+		}
+		return version, nil
+	}
+}
+
+// checkCacheDir checks that files can be written to the cache directory.
+func checkCacheDir(ctx context.Context) (string, error) {
+	f, err := os.CreateTemp(conf.CacheDir, "readyz-*.tmp")
+	if err != nil {
+		return conf.CacheDir, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return conf.CacheDir, err
+	}
+	return conf.CacheDir, f.Close()
+}
+
+// checkTemplate checks that the files copied into every build are present.
+func checkTemplate(ctx context.Context) (string, error) {
+	for _, fn := range []string{"go.mod", "go.sum"} {
+		if _, err := fs.Stat(templateFS(), fn); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// checkBucket checks that the Google Cloud Storage bucket is accessible.
+func checkBucket(ctx context.Context) (string, error) {
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		return "", err
+	}
+	return attrs.Name, nil
+}
+
+// checkFirestore checks that Firestore can be queried.
+func checkFirestore(ctx context.Context) (string, error) {
+	if err := startFirebase(); err != nil {
+		return "", err
+	}
+	iter := firestoreClient.Collection("shared").Limit(1).Documents(ctx)
+	defer iter.Stop()
+	if _, err := iter.Next(); err != nil && !errors.Is(err, iterator.Done) {
+		return "", err
+	}
+	return "", nil
+}
+
+// runSmokeTest compiles a small program through the compile queue and stores
+// the result for checkSmokeTest. It is started once when the server starts.
+func runSmokeTest(ctx context.Context) {
+	detail, err := smokeTestCompile(ctx)
+	if err != nil {
+		logger(ctx).Error("smoke test failed", "err", err)
+	} else {
+		logger(ctx).Info("smoke test passed", "detail", detail)
+	}
+	smokeTest.lock.Lock()
+	defer smokeTest.lock.Unlock()
+	smokeTest.done = true
+	smokeTest.detail = detail
+	smokeTest.err = err
+}
+
+// smokeTestCompile compiles the smoke test program for the console board.
+func smokeTestCompile(ctx context.Context) (string, error) {
+	lib, err := getPartsLibrary()
+	if err != nil {
+		return "", err
+	}
+	board, err := lib.board("console")
+	if err != nil {
+		return "", err
+	}
+	start := time.Now()
+	if err := compileSource(ctx, []byte(smokeTestSource), "tinygo", board, "wasi"); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("compiled in %.1fs", time.Since(start).Seconds()), nil
+}
+
+// checkSmokeTest reports the result of the smoke test run at startup. The
+// instance isn't ready until it has passed.
+func checkSmokeTest(ctx context.Context) (string, error) {
+	smokeTest.lock.Lock()
+	defer smokeTest.lock.Unlock()
+	if !smokeTest.done {
+		return "", errors.New("smoke test is still running")
+	}
+	return smokeTest.detail, smokeTest.err
+}
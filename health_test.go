@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadyzDraining(t *testing.T) {
+	draining.Store(true)
+	t.Cleanup(func() { draining.Store(false) })
+	w := httptest.NewRecorder()
+	handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != 503 || !strings.Contains(w.Body.String(), `"draining"`) {
+		t.Errorf("got %d %s, expected 503 while draining", w.Code, w.Body)
+	}
+}
+
+func TestCheckSmokeTest(t *testing.T) {
+	t.Cleanup(func() {
+		smokeTest.done, smokeTest.detail, smokeTest.err = false, "", nil
+	})
+	ctx := context.Background()
+	if _, err := checkSmokeTest(ctx); err == nil {
+		t.Error("ready before the smoke test has finished")
+	}
+
+	// The check reports the stored result, without compiling anything.
+	smokeTest.done, smokeTest.err = true, errors.New("compile failed")
+	if _, err := checkSmokeTest(ctx); err == nil || err.Error() != "compile failed" {
+		t.Errorf("got error %v, expected the smoke test error", err)
+	}
+	smokeTest.detail, smokeTest.err = "compiled in 1.0s", nil
+	if detail, err := checkSmokeTest(ctx); err != nil || detail != "compiled in 1.0s" {
+		t.Errorf("got %q %v", detail, err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+// This file implements opening the listeners the server accepts connections
+// on: TCP addresses, Unix domain sockets and sockets passed in by systemd,
+// optionally with TLS.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listener is a listener opened for a single listen address.
+type listener struct {
+	net.Listener
+	Addr string // address as configured
+	TLS  bool   // whether to serve HTTPS on this listener
+}
+
+// openListeners opens listeners for all the given addresses. Addresses are
+// one of the following, optionally prefixed with "tls:" to serve HTTPS:
+//
+//	host:port       TCP address, like ":8080" or "127.0.0.1:8080"
+//	unix:path       Unix domain socket
+//	systemd:        all sockets passed in by systemd socket activation
+//	systemd:name    sockets passed in by systemd with the given FileDescriptorName
+func openListeners(addrs []string) ([]listener, error) {
+	var systemd map[string][]net.Listener
+	var listeners []listener
+	for _, addr := range addrs {
+		l := listener{Addr: addr}
+		rest := addr
+		if strings.HasPrefix(rest, "tls:") {
+			l.TLS = true
+			rest = strings.TrimPrefix(rest, "tls:")
+		}
+		switch {
+		case strings.HasPrefix(rest, "unix:"):
+			path := strings.TrimPrefix(rest, "unix:")
+			// Remove a stale socket left behind by a previous run.
+			if st, err := os.Stat(path); err == nil && st.Mode()&os.ModeSocket != 0 {
+				os.Remove(path)
+			}
+			ln, err := net.Listen("unix", path)
+			if err != nil {
+				return nil, err
+			}
+			l.Listener = ln
+			listeners = append(listeners, l)
+		case strings.HasPrefix(rest, "systemd:"):
+			if systemd == nil {
+				var err error
+				systemd, err = systemdListeners()
+				if err != nil {
+					return nil, err
+				}
+			}
+			name := strings.TrimPrefix(rest, "systemd:")
+			found := false
+			for fdName, lns := range systemd {
+				if name != "" && name != fdName {
+					continue
+				}
+				for _, ln := range lns {
+					l.Listener = ln
+					listeners = append(listeners, l)
+					found = true
+				}
+				delete(systemd, fdName) // each socket can only be used once
+			}
+			if !found {
+				return nil, fmt.Errorf("no sockets passed in by systemd for %s", addr)
+			}
+		default:
+			ln, err := net.Listen("tcp", rest)
+			if err != nil {
+				return nil, err
+			}
+			l.Listener = ln
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners, nil
+}
+
+// systemdListeners returns the sockets passed in by systemd socket activation,
+// by FileDescriptorName. See sd_listen_fds(3).
+func systemdListeners() (map[string][]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed in by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	const firstFD = 3 // SD_LISTEN_FDS_START
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		fd := firstFD + i
+		syscall.CloseOnExec(fd)
+		name := "unknown" // default used by systemd
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener made a copy
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s) passed in by systemd: %w", fd, name, err)
+		}
+		listeners[name] = append(listeners[name], ln)
+	}
+	return listeners, nil
+}
+
+// certReloader loads a TLS certificate and key, and loads them again when the
+// process receives SIGHUP so that certificates can be renewed without a
+// restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newCertReloader loads the certificate and key from the given files and
+// starts listening for SIGHUP.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGHUP)
+		for range ch {
+			if err := r.reload(); err != nil {
+				// Keep using the old certificate.
+				slog.Error("could not reload TLS certificate", "err", err)
+				continue
+			}
+			slog.Info("reloaded TLS certificate", "cert", certFile)
+		}
+	}()
+	return r, nil
+}
+
+// reload loads the certificate and key from disk.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.cert = &cert
+	r.lock.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate. It is used as
+// tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
@@ -5,18 +5,24 @@ package main
 // This file implements the HTTP frontend.
 
 import (
-	"compress/gzip"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
-	"io"
+	"fmt"
+	"io/fs"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -31,36 +37,49 @@ var (
 	// The channel to submit compile jobs to.
 	compilerChan chan compilerJob
 
-	// The cache directory where cached wasm files are stored.
-	cacheDir string
-
 	// The cache type: local or Google Cloud Storage.
 	cacheType int
 
 	bucket *storage.BucketHandle
-
-	firebaseCredentials string
 )
 
+// Formats of firmware that can be flashed to a board. The bundle format is a
+// zip file with the firmware in several formats, see firmwareBundle.
+var firmwareFormats = []string{"elf", "hex", "bin", "uf2", "bundle"}
+
 func main() {
-	// Create a build cache directory.
-	userCacheDir, err := os.UserCacheDir()
+	var err error
+	printConfig := flag.Bool("print-config", false, "print the effective configuration as a JSON configuration file and exit")
+	conf, err = loadConfig(flag.CommandLine, os.Args[1:])
 	if err != nil {
-		log.Fatalln("could not find temporary directory:", err)
+		fatal("could not load configuration", "err", err)
 	}
-	cacheDir = filepath.Join(userCacheDir, "tinygo-playground")
-	err = os.MkdirAll(cacheDir, 0777)
-	if err != nil {
-		log.Fatalln("could not create temporary directory:", err)
+	if *printConfig {
+		data, err := conf.marshalIndent()
+		if err != nil {
+			fatal("could not print configuration", "err", err)
+		}
+		os.Stdout.Write(data)
+		return
 	}
 
-	dir := flag.String("dir", ".", "which directory to serve from")
-	cacheTypeFlag := flag.String("cache-type", "local", "cache type (local, gcs)")
-	bucketNameFlag := flag.String("bucket-name", "", "Google Cloud Storage bucket name")
-	flag.StringVar(&firebaseCredentials, "firebase-credentials", "", "path to JSON file with Firebase credentials")
-	flag.Parse()
+	if err := setupLogging(conf.LogLevel, conf.LogFormat); err != nil {
+		fatal("could not set up logging", "err", err)
+	}
+	if data, err := json.Marshal(conf); err == nil {
+		slog.Info("effective configuration", "config", string(data))
+	}
+
+	// Create a build cache directory.
+	if conf.CacheDir == "" {
+		fatal("could not find temporary directory, set -cache-dir instead")
+	}
+	err = os.MkdirAll(conf.CacheDir, 0777)
+	if err != nil {
+		fatal("could not create temporary directory", "err", err)
+	}
 
-	switch *cacheTypeFlag {
+	switch conf.CacheType {
 	case "local":
 		cacheType = cacheTypeLocal
 	case "gcs":
@@ -68,43 +87,188 @@ func main() {
 		ctx := context.Background()
 		client, err := storage.NewClient(ctx)
 		if err != nil {
-			log.Fatalln("could not create Google Cloud Storage client:", err)
+			fatal("could not create Google Cloud Storage client", "err", err)
 		}
-		bucket = client.Bucket(*bucketNameFlag)
+		bucket = client.Bucket(conf.BucketName)
 	default:
-		log.Fatalln("unrecognized cache type:", *cacheTypeFlag)
+		fatal("unrecognized cache type", "cache_type", conf.CacheType)
 	}
 
+	proxies, err = parseProxyConfig(conf.TrustedProxies, conf.ProxyHops)
+	if err != nil {
+		fatal("could not parse proxy configuration", "err", err)
+	}
+
+	switch conf.ShareIPMode {
+	case "obfuscated", "hash", "none":
+	default:
+		fatal("unrecognized share IP mode", "share_ip_mode", conf.ShareIPMode)
+	}
+	if conf.IPRetentionDays < 0 {
+		fatal("invalid IP retention period", "ip_retention_days", conf.IPRetentionDays)
+	}
+	shares, err = openShareStore(conf.ShareStorage, conf.SharePath)
+	if err != nil {
+		fatal("could not open share storage", "err", err)
+	}
+	defer shares.Close()
+
+	sink, err := openAnalyticsSink(conf.AnalyticsSink, conf.AnalyticsPath)
+	if err != nil {
+		fatal("could not open analytics sink", "err", err)
+	}
+	analytics = newAnalyticsQueue(sink)
+	defer analytics.Close()
+
 	// Start the compiler goroutine in the background, that will serialize all
 	// compile jobs.
 	compilerChan = make(chan compilerJob)
 	go backgroundCompiler(compilerChan)
 
+	// Run a subcommand instead of the web server, if requested.
+	switch flag.Arg(0) {
+	case "":
+	case "warm":
+		warmCache(flag.Args()[1:])
+		return
+	case "export-shares":
+		exportShares(flag.Args()[1:])
+		return
+	case "import-shares":
+		importShares(flag.Args()[1:])
+		return
+	case "validate-parts":
+		validatePartsCommand(flag.Args()[1:])
+		return
+	case "privacy-export":
+		privacyExport(flag.Args()[1:])
+		return
+	default:
+		fatal("unknown subcommand", "subcommand", flag.Arg(0))
+	}
+
 	// Run the web server.
 	http.HandleFunc("/api/compile", handleCompile)
+	http.HandleFunc("GET /api/artifacts/{compiler}/{target}/{file}", handleArtifact)
 	http.HandleFunc("/api/share", handleShare)
-	http.HandleFunc("/api/stats", getStats)
-	http.Handle("/", addHeaders(http.FileServer(http.Dir(*dir))))
-	log.Print("Serving " + *dir + " on http://localhost:8080")
-	http.ListenAndServe(":8080", nil)
+	http.HandleFunc("/api/share/{id}", handleShareID)
+	http.HandleFunc("GET /api/share/{id}/history", handleShareHistory)
+	http.HandleFunc("GET /api/share/{id}/forks", handleShareForks)
+	http.HandleFunc("GET /api/share/{id}/export", handleShareExport)
+	http.HandleFunc("/api/stats", handleStats)
+	http.HandleFunc("/metrics", handleMetrics)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.Handle("/", newStaticHandler(frontendFS()))
+	// Compile jobs started from HTTP requests derive their context from
+	// jobsContext, so they can all be cancelled during shutdown.
+	jobsContext, cancelJobs := context.WithCancel(context.Background())
+	if conf.ShareSweepInterval > 0 {
+		go sweepExpiredShares(jobsContext, time.Duration(conf.ShareSweepInterval))
+	}
+	if conf.IPRetentionDays > 0 {
+		go enforceIPRetention(jobsContext, conf.IPRetentionDays)
+	}
+	if conf.ReadyzSmokeTest {
+		go runSmokeTest(jobsContext)
+	}
+	server := &http.Server{
+		Handler: countInFlight(withRequestID(withClientIP(http.DefaultServeMux))),
+		BaseContext: func(net.Listener) context.Context {
+			return jobsContext
+		},
+	}
+	listeners, err := openListeners(conf.Listen)
+	if err != nil {
+		fatal("could not listen", "err", err)
+	}
+	for _, l := range listeners {
+		if l.TLS && server.TLSConfig == nil {
+			// HTTPS, with the certificate reloaded on SIGHUP. HTTP/2 is
+			// enabled automatically by ServeTLS.
+			if conf.TLSCert == "" || conf.TLSKey == "" {
+				fatal("TLS listener configured without certificate", "addr", l.Addr)
+			}
+			certs, err := newCertReloader(conf.TLSCert, conf.TLSKey)
+			if err != nil {
+				fatal("could not load TLS certificate", "err", err)
+			}
+			server.TLSConfig = &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: certs.GetCertificate,
+			}
+		}
+	}
+	dir := conf.Dir
+	if dir == "" {
+		dir = "(embedded)"
+	}
+	for _, l := range listeners {
+		slog.Info("serving "+dir, "dir", dir, "addr", l.Listener.Addr().String(), "tls", l.TLS)
+		go func() {
+			var err error
+			if l.TLS {
+				err = server.ServeTLS(l.Listener, "", "")
+			} else {
+				err = server.Serve(l.Listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				fatal("could not serve", "addr", l.Addr, "err", err)
+			}
+		}()
+	}
+
+	// Wait for a signal to shut down.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	<-ctx.Done()
+	shutdown(server, cancelJobs, time.Duration(conf.DrainTimeout))
 }
 
-func addHeaders(fs http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Add headers that enable greater accuracy of performance.now() in
-		// Firefox.
-		w.Header().Add("Cross-Origin-Opener-Policy", "same-origin")
-		w.Header().Add("Cross-Origin-Embedder-Policy", "require-corp")
+// shutdown stops the server gracefully. It stops accepting new connections and
+// compile jobs, and waits for running requests (and with them, compile jobs,
+// cache uploads and tracking writes) to finish. Compile jobs that are still
+// running after the drain timeout are cancelled.
+func shutdown(server *http.Server, cancelJobs context.CancelFunc, drainTimeout time.Duration) {
+	slog.Info("shutting down", "drain_timeout", drainTimeout)
+	startDraining()
 
-		fs.ServeHTTP(w, r)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err == nil {
+		slog.Info("shutdown complete")
+		return
+	}
+
+	// Some requests are still running after the deadline. Cancel the compile
+	// jobs (which kills the compiler), and give the requests a bit more time
+	// to return an error and finish their uploads.
+	slog.Warn("drain timeout exceeded, cancelling compile jobs", "err", err)
+	cancelJobs()
+	ctx, cancel = context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+	if err := waitForJobs(ctx); err != nil {
+		slog.Error("compile jobs did not finish", "err", err)
 	}
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("could not shut down server", "err", err)
+		server.Close()
+		return
+	}
+	slog.Info("shutdown complete")
 }
 
+// The board to compile for if a compile request doesn't specify a target, as
+// older clients didn't. It is the board of the default project.
+const defaultTarget = "console"
+
 // handleCompile handles the /api/compile API endpoint. It first tries to serve
 // from a cache and if that fails, compiles the submitted source code directly.
 func handleCompile(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "TinyGo-Page, TinyGo-Modified")
+	w.Header().Set("Access-Control-Allow-Headers", "TinyGo-Page, TinyGo-Modified, If-None-Match, X-Request-ID")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Request-ID")
 
 	var source []byte
 	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
@@ -123,59 +287,138 @@ func handleCompile(w http.ResponseWriter, r *http.Request) {
 	sourceHashRaw := sha256.Sum256([]byte(source))
 	sourceHash := hex.EncodeToString(sourceHashRaw[:])
 
-	// Check 'format' parameter.
+	// Check 'compiler' parameter.
+	compiler := r.FormValue("compiler")
+	if compiler == "" {
+		compiler = "tinygo" // legacy fallback
+	}
+	switch compiler {
+	case "go", "tinygo":
+	default:
+		// Unrecognized compiler.
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("unrecognized compiler"))
+		return
+	}
+
+	// Check 'target' parameter. It is used as part of the cache filename and
+	// artifact URL.
+	target := r.FormValue("target")
+	if target == "" {
+		target = defaultTarget // legacy fallback
+	}
+	if !validTarget.MatchString(target) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("unrecognized target"))
+		return
+	}
+
+	lib, err := getPartsLibrary()
+	if err != nil {
+		logger(r.Context()).Error("could not load parts", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	board, err := lib.board(target)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errNotABoard) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("unrecognized target"))
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("could not read board", "target", target, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Check 'format' parameter, against the formats the board supports.
 	format := r.FormValue("format")
 	if format == "" {
 		// backwards compatibility (the format should be specified)
-		format = "wasm"
+		format = board.defaultFormat()
 	}
 	flashFirmware := false
-	switch format {
-	case "wasm", "wasi":
+	switch {
+	case format == "wasm" || format == "wasi":
 		// Run code in the browser.
-	case "elf", "hex", "uf2":
+	case slices.Contains(firmwareFormats, format):
 		// Build a firmware that can be flashed directly to a development board.
 		flashFirmware = true
 	default:
 		// Unrecognized format. Disallow to be sure (might introduce security
 		// issues otherwise).
+		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("unrecognized format"))
+		return
+	}
+	if flashFirmware && (compiler != "tinygo" || !slices.Contains(board.supportedFirmwareFormats(), format)) {
 		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "format %s is not supported for %s with compiler %s", format, board.HumanName, compiler)
 		return
 	}
 
-	// Check 'compiler' parameter.
-	compiler := r.FormValue("compiler")
-	if compiler == "" {
-		compiler = "tinygo" // legacy fallback
+	// Track this compile action (after we're done compiling), unless the
+	// user opted out. The outcome and other details are filled in below.
+	event := compileEvent{
+		Time:          time.Now(),
+		Page:          r.Header.Get("TinyGo-Page"),
+		Compiler:      compiler,
+		Target:        target,
+		FlashFirmware: flashFirmware,
 	}
-	switch compiler {
-	case "go", "tinygo":
-	default:
-		// Unrecognized compiler.
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("unrecognized compiler"))
-		return
+	defer func() {
+		if !trackingOptOut(r) {
+			trackCompile(event, r.Header.Get("TinyGo-Modified"))
+		}
+	}()
+
+	// The ETag only depends on the cache key, so a client that already has
+	// this build doesn't need it to be compiled again. The build must still be
+	// cached though, so that it is also available at its artifact URL.
+	// Otherwise it is compiled again below.
+	filename := artifactFilename(compiler, target, sourceHash, format)
+	enc := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if etagMatch(r.Header.Get("If-None-Match"), artifactETag(filename, enc)) {
+		exists, err := artifactExists(r.Context(), filename)
+		if err != nil {
+			logger(r.Context()).Error("could not check for artifact", "err", err)
+		}
+		if exists {
+			setArtifactHeaders(w, filename, format, enc)
+			w.WriteHeader(http.StatusNotModified)
+			event.Outcome = "success"
+			event.CacheTier = "client"
+			return
+		}
 	}
 
-	// Track this compile action (after we're done compiling).
-	defer trackCompile(map[string]any{
-		"page":          r.Header.Get("TinyGo-Page"),
-		"compiler":      compiler,
-		"target":        r.FormValue("target"),
-		"flashFirmware": flashFirmware,
-		"timestamp":     time.Now().UTC().Truncate(time.Hour * 24),
-	}, r.Header.Get("TinyGo-Modified"))
+	// The result is also available at a content-addressed URL once it is
+	// cached. Clients can ask to be redirected there (with redirect=1)
+	// instead of receiving the result directly.
+	location := artifactURL(compiler, target, sourceHash, format)
+	sendResult := func(fp *os.File) {
+		defer fp.Close()
+		if r.FormValue("redirect") == "1" {
+			http.Redirect(w, r, location, http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("Content-Location", location)
+		sendCompiledResult(w, r, fp, filename, format, enc)
+	}
 
-	// Attempt to serve directly from the directory with cached files.
-	filename := filepath.Join(cacheDir, "build-"+compiler+"-"+r.FormValue("target")+"-"+sourceHash+"."+format)
-	fp, err := os.Open(filename)
-	if err == nil {
+	// Attempt to serve directly from the directory with cached files. The
+	// file is opened right away, so that cleaning up the cache can't remove
+	// it before it is sent.
+	if fp, err := openArtifact(filename, enc); err == nil {
 		// File was already cached! Serve it directly.
-		defer fp.Close()
-		sendCompiledResult(w, fp, format)
+		metricCacheHits.Inc("local")
+		logger(r.Context()).Info("compile served from cache", "compiler", compiler, "target", target, "format", format, "cache", "local")
+		event.Outcome = "success"
+		event.CacheTier = "local"
+		sendResult(fp)
 		return
 	}
+	metricCacheMisses.Inc("local")
 
 	// Create a new compiler job, which will be executed in a single goroutine
 	// (to avoid overloading the system).
@@ -184,47 +427,37 @@ func handleCompile(w http.ResponseWriter, r *http.Request) {
 		SourceHash:   sourceHash,
 		Filename:     filename,
 		Compiler:     compiler,
-		Target:       r.FormValue("target"),
+		Target:       target,
+		Board:        board,
 		Format:       format,
+		Encoding:     enc,
 		Context:      r.Context(),
-		ResultFile:   make(chan string),
+		ResultFile:   make(chan *os.File),
 		ResultErrors: make(chan []byte),
+		Queued:       time.Now(),
+		RequestID:    requestID(r.Context()),
+		Stats:        &compileStats{},
 	}
 	// Send the job for execution.
-	compilerChan <- job
-	// See how well that went, when it finishes.
+	if err := queueJob(job); err != nil {
+		// The server is shutting down. Another instance should pick up the
+		// request.
+		event.Outcome = "error"
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// See how well that went, when it finishes. The job stats are complete
+	// once the result is received.
 	select {
-	case filename := <-job.ResultFile:
+	case fp := <-job.ResultFile:
 		// Succesful compilation.
-		fp, err := os.Open(filename)
-		if err != nil {
-			log.Println("could not open compiled file:", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		defer fp.Close()
-		sendCompiledResult(w, fp, format)
+		job.Stats.apply(&event)
+		sendResult(fp)
 	case buf := <-job.ResultErrors:
 		// Failed compilation.
+		job.Stats.apply(&event)
 		w.Write(buf)
 	}
 }
-
-// sendCompiledResult streams a wasm file while gzipping it during transfer.
-func sendCompiledResult(w http.ResponseWriter, fp *os.File, format string) {
-	switch format {
-	case "wasm", "wasi":
-		w.Header().Set("Content-Type", "application/wasm")
-	default:
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Disposition", "attachment; filename=firmware."+format)
-	}
-	w.Header().Set("Content-Encoding", "gzip")
-	gw := gzip.NewWriter(w)
-	_, err := io.Copy(gw, fp)
-	if err != nil {
-		log.Println("could not read compiled file:", err)
-		return
-	}
-	gw.Close()
-}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleCompileTarget(t *testing.T) {
+	useCacheDir(t)
+	const source = "package main"
+	sum := sha256.Sum256([]byte(source))
+	writeArtifact(t, artifactFilename("tinygo", defaultTarget, hex.EncodeToString(sum[:]), "wasm"), time.Now())
+
+	for _, tc := range []struct {
+		target string
+		status int
+		body   string
+	}{
+		{"", 200, "data:"}, // the default board, from the cache
+		{defaultTarget, 200, "data:"},
+		{"nonexistent", 400, "unrecognized target"},
+		{"parts", 400, "unrecognized target"},
+		{"../console", 400, "unrecognized target"},
+	} {
+		form := url.Values{"code": {source}}
+		if tc.target != "" {
+			form.Set("target", tc.target)
+		}
+		r := httptest.NewRequest("POST", "/api/compile", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("DNT", "1")
+		w := httptest.NewRecorder()
+		handleCompile(w, r)
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Errorf("target %q: got %d %q, expected %d %q", tc.target, w.Code, w.Body, tc.status, tc.body)
+		}
+	}
+}
+
+func TestHandleCompileETag(t *testing.T) {
+	useCacheDir(t)
+	const source = "package main"
+	sum := sha256.Sum256([]byte(source))
+	filename := artifactFilename("tinygo", defaultTarget, hex.EncodeToString(sum[:]), "wasm")
+	etag := artifactETag(filename, artifactEncodings[0])
+	compile := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/compile?target="+defaultTarget, strings.NewReader(source))
+		r.Header.Set("Content-Type", "text/plain")
+		r.Header.Set("Accept-Encoding", "br")
+		r.Header.Set("If-None-Match", etag)
+		r.Header.Set("DNT", "1")
+		w := httptest.NewRecorder()
+		handleCompile(w, r)
+		return w
+	}
+
+	writeArtifact(t, filename, time.Now())
+	if w := compile(); w.Code != http.StatusNotModified {
+		t.Errorf("cached artifact: status %d, expected %d", w.Code, http.StatusNotModified)
+	}
+
+	// Once the artifact is removed from the cache, it must be compiled again.
+	// Refuse new compile jobs to see that it would be.
+	for _, enc := range artifactEncodings {
+		os.Remove(filename + enc.Suffix)
+	}
+	draining.Store(true)
+	defer draining.Store(false)
+	if w := compile(); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("removed artifact: status %d, expected a compile job to be queued", w.Code)
+	}
+}
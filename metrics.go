@@ -0,0 +1,205 @@
+package main
+
+// This file implements a small metrics registry, exposed at /metrics in the
+// Prometheus text format.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Histogram buckets (in seconds) for durations of compile jobs.
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 60}
+
+var (
+	metricQueueDepth      = newMetric("gauge", "playground_compile_queue_depth", "Number of compile jobs waiting to be started.")
+	metricQueueWait       = newHistogram("playground_compile_queue_wait_seconds", "Time compile jobs spent waiting in the queue.", durationBuckets)
+	metricCompileDuration = newHistogram("playground_compile_duration_seconds", "Duration of compiler invocations.", durationBuckets, "compiler", "target", "format")
+	metricCompiles        = newMetric("counter", "playground_compiles_total", "Number of compiler invocations by result (success or failure).", "compiler", "target", "format", "result")
+	metricCacheHits       = newMetric("counter", "playground_cache_hits_total", "Number of compile results served from a cache, by cache tier (local or gcs).", "tier")
+	metricCacheMisses     = newMetric("counter", "playground_cache_misses_total", "Number of compile results not found in a cache, by cache tier (local or gcs).", "tier")
+	metricCacheSize       = newMetric("gauge", "playground_cache_size_bytes", "Size of the local cache directory, as measured during the last cleanup.")
+	metricCacheEvictions  = newMetric("counter", "playground_cache_evictions_total", "Number of files removed from the local cache.")
+	metricShareReads      = newMetric("counter", "playground_share_reads_total", "Number of shared snippets read.")
+	metricShareWrites     = newMetric("counter", "playground_share_writes_total", "Number of shared snippets stored.")
+	metricShareErrors     = newMetric("counter", "playground_share_errors_total", "Number of errors while reading or storing shared snippets.", "operation")
+	metricShareDeletes    = newMetric("counter", "playground_share_deletes_total", "Number of shared snippets deleted, by reason (owner or expired).", "reason")
+	metricAnalyticsEvents = newMetric("counter", "playground_analytics_events_total", "Number of tracked compile events, by result (written, dropped or error).", "result")
+	metricHTTPInFlight    = newMetric("gauge", "playground_http_requests_in_flight", "Number of HTTP requests currently being served.")
+)
+
+// All registered metrics, in the order they were created.
+var allMetrics []*metric
+
+// metric is a single counter, gauge or histogram, with zero or more labels.
+type metric struct {
+	typ     string // "counter", "gauge" or "histogram"
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, only for histograms
+
+	lock   sync.Mutex
+	series map[string]*metricSeries
+}
+
+// metricSeries is the value of a metric for a single set of label values.
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counter or gauge value, or histogram sum
+	count       uint64   // histogram count
+	buckets     []uint64 // histogram bucket counts (not cumulative)
+}
+
+// newMetric creates and registers a new counter or gauge.
+func newMetric(typ, name, help string, labels ...string) *metric {
+	m := &metric{
+		typ:    typ,
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*metricSeries),
+	}
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+// newHistogram creates and registers a new histogram with the given bucket
+// upper bounds.
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	m := newMetric("histogram", name, help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+// get returns the series for the given label values, creating it if needed.
+// The lock must be held.
+func (m *metric) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(m.labels) {
+		panic("metric " + m.name + ": wrong number of label values")
+	}
+	key := strings.Join(labelValues, "\xff")
+	s := m.series[key]
+	if s == nil {
+		s = &metricSeries{
+			labelValues: labelValues,
+			buckets:     make([]uint64, len(m.buckets)),
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Add adds the given value to a counter or gauge.
+func (m *metric) Add(value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(labelValues).value += value
+}
+
+// Inc increments a counter or gauge by one.
+func (m *metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Set sets a gauge to the given value.
+func (m *metric) Set(value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(labelValues).value = value
+}
+
+// Observe adds a single observation to a histogram.
+func (m *metric) Observe(value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := m.get(labelValues)
+	s.value += value
+	s.count++
+	for i, upperBound := range m.buckets {
+		if value <= upperBound {
+			s.buckets[i]++
+			break
+		}
+	}
+}
+
+// write writes the metric in the Prometheus text format.
+func (m *metric) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+	if len(m.labels) == 0 {
+		// Always report metrics without labels, even if they're zero.
+		m.get(nil)
+	}
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.formatLabels(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		cumulative := uint64(0)
+		for i, upperBound := range m.buckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(s.labelValues, formatFloat(upperBound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.formatLabels(s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.formatLabels(s.labelValues, ""), s.count)
+	}
+}
+
+// formatLabels returns the label set for the given label values, including the
+// "le" label for histogram buckets if non-empty.
+func (m *metric) formatLabels(labelValues []string, le string) string {
+	var pairs []string
+	for i, label := range m.labels {
+		pairs = append(pairs, label+`="`+labelEscaper.Replace(labelValues[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Escapes label values as required by the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// handleMetrics handles the /metrics endpoint.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
+
+// countInFlight wraps a HTTP handler to track the number of requests that are
+// currently being served.
+func countInFlight(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metricHTTPInFlight.Add(1)
+		defer metricHTTPInFlight.Add(-1)
+		h.ServeHTTP(w, r)
+	})
+}
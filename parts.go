@@ -0,0 +1,463 @@
+package main
+
+// This file defines the board and part definitions in parts/*.json, which are
+// otherwise only read by the frontend, and implements the "validate-parts"
+// subcommand that checks them.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// partDefinition is a board or composite part defined in parts/*.json. It is
+// drawn using its SVG and consists of simulated subparts, connected to each
+// other and to the pins in the SVG with wires.
+type partDefinition struct {
+	Name           string              `json:"name"`
+	HumanName      string              `json:"humanName"`
+	SVG            string              `json:"svg,omitempty"`            // relative to the JSON file
+	MainPart       string              `json:"mainPart,omitempty"`       // ID of the subpart running the code, set for boards
+	FirmwareFormat string              `json:"firmwareFormat,omitempty"` // format to flash, empty if the board can't be flashed
+	BaseCurrent    float64             `json:"baseCurrent,omitempty"`    // current used by the board itself, in amperes
+	Parts          []subpartDefinition `json:"parts"`
+	Wires          []shareWire         `json:"wires,omitempty"`
+
+	// How to compile code for a board. See the methods below for the
+	// defaults if these are not set.
+	Target          string   `json:"target,omitempty"`          // TinyGo target to build firmware for
+	SimulationTags  []string `json:"simulationTags,omitempty"`  // build tags when compiling for the simulator
+	FirmwareFormats []string `json:"firmwareFormats,omitempty"` // firmware formats that can be built
+	DefaultFormat   string   `json:"defaultFormat,omitempty"`   // format if a compile request doesn't specify one
+	UF2FamilyID     string   `json:"uf2FamilyID,omitempty"`     // UF2 family ID of the chip, like "0xe48bff56"
+}
+
+// isBoard returns whether the definition is a board, that code can run on.
+func (def *partDefinition) isBoard() bool {
+	return def.MainPart != ""
+}
+
+// buildTarget returns the TinyGo target to build firmware for the board. It
+// defaults to the name of the board.
+func (def *partDefinition) buildTarget() string {
+	if def.Target != "" {
+		return def.Target
+	}
+	return def.Name
+}
+
+// buildTags returns the build tags to compile code for the simulated board.
+// They default to the name of the board, with '-' replaced by '_' because '-'
+// is not allowed in build tags.
+func (def *partDefinition) buildTags() []string {
+	if def.SimulationTags != nil {
+		return def.SimulationTags
+	}
+	return []string{strings.ReplaceAll(def.Name, "-", "_")}
+}
+
+// supportedFirmwareFormats returns the firmware formats that can be built for
+// the board. They default to the format to flash, if any.
+func (def *partDefinition) supportedFirmwareFormats() []string {
+	if def.FirmwareFormats != nil {
+		return def.FirmwareFormats
+	}
+	if def.FirmwareFormat != "" {
+		return []string{def.FirmwareFormat}
+	}
+	return nil
+}
+
+// uf2FamilyID returns the parsed UF2 family ID, which is needed to build
+// firmware in the UF2 format.
+func (def *partDefinition) uf2FamilyID() (uint32, error) {
+	if def.UF2FamilyID == "" {
+		return 0, fmt.Errorf("board %s has no UF2 family ID", def.Name)
+	}
+	id, err := strconv.ParseUint(def.UF2FamilyID, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("board %s has an invalid UF2 family ID %q", def.Name, def.UF2FamilyID)
+	}
+	return uint32(id), nil
+}
+
+// defaultFormat returns the format to compile to if a compile request doesn't
+// specify one. It defaults to "wasm" for backwards compatibility.
+func (def *partDefinition) defaultFormat() string {
+	if def.DefaultFormat != "" {
+		return def.DefaultFormat
+	}
+	return "wasm"
+}
+
+// subpartDefinition is a single simulated part in a partDefinition. Which
+// fields are used depends on the type.
+type subpartDefinition struct {
+	ID             string    `json:"id"`
+	Type           string    `json:"type"`
+	HumanName      string    `json:"humanName,omitempty"`
+	Pins           mcuPins   `json:"pins,omitempty"`           // mcu
+	Color          []int     `json:"color,omitempty"`          // led
+	Current        float64   `json:"current,omitempty"`        // led, dummy
+	ChannelCurrent []float64 `json:"channelCurrent,omitempty"` // ws2812
+	Length         int       `json:"length,omitempty"`         // ws2812
+	Width          int       `json:"width,omitempty"`          // st7789
+	Height         int       `json:"height,omitempty"`         // st7789
+	Key            string    `json:"key,omitempty"`            // pushbutton
+	AxisMap        []int     `json:"axisMap,omitempty"`        // lis3dh
+}
+
+// mcuPins maps the pin names of an MCU to pin numbers. A MCU without pins may
+// also be written as an empty array.
+type mcuPins map[string]int
+
+func (p *mcuPins) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("[]")) {
+		*p = mcuPins{}
+		return nil
+	}
+	return json.Unmarshal(data, (*map[string]int)(p))
+}
+
+// partsIndex is the format of parts/parts.json, which lists the parts that can
+// be added to a schematic.
+type partsIndex struct {
+	Parts []partsIndexEntry `json:"parts"`
+}
+
+// partsIndexEntry is a part in parts/parts.json: either a simple part
+// configured inline, or a part defined in the JSON file at Location.
+type partsIndexEntry struct {
+	Location string                      `json:"location,omitempty"`
+	Config   sharePartConfig             `json:"config"`
+	Options  map[string]map[string][]int `json:"options,omitempty"` // choices shown when adding the part, like colors
+}
+
+// Pins of the simulated part types, as created in worker/parts.js. MCUs have
+// the pins listed in their definition.
+var partTypePins = map[string][]string{
+	"board":      nil,
+	"dummy":      nil,
+	"mcu":        nil,
+	"pushbutton": {"A", "B"},
+	"led":        {"anode", "cathode"},
+	"rgbled":     {"r", "g", "b"},
+	"ws2812":     {"din", "dout"},
+	"lis3dh":     {"scl", "sda", "sa0"},
+	"epd2in13":   {"sck", "sdi", "cs", "dc", "rst", "busy"},
+	"st7789":     {"sck", "sdi", "cs", "dc", "reset"},
+	"servo":      {"control"},
+}
+
+// Pins every board and composite part has, besides the pins in its SVG.
+var partPowerPins = []string{"vcc", "gnd"}
+
+// Build tags as accepted by "go build -tags".
+var validBuildTag = regexp.MustCompile(`^[a-zA-Z0-9_.]+$`)
+
+// Pin number used by the frontend for "no pin", so it can't be used in a pin
+// map.
+const mcuNoPin = 255
+
+// partsProblem is a single problem found by validateParts.
+type partsProblem struct {
+	File    string `json:"file"`            // like parts/arduino.json
+	Field   string `json:"field,omitempty"` // like wires[3].to
+	Code    string `json:"code"`            // kind of problem, like unknown-pin
+	Message string `json:"message"`
+}
+
+func (p partsProblem) String() string {
+	if p.Field == "" {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", p.File, p.Field, p.Message)
+}
+
+// readPartDefinition reads the board or part definition at the given path.
+// Unknown fields are an error, to catch typos.
+func readPartDefinition(fsys fs.FS, name string) (*partDefinition, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	var def partDefinition
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&def); err != nil {
+		return nil, err
+	}
+	return &def, nil
+}
+
+var errNotABoard = errors.New("not a board")
+
+// board returns the definition of the board with the given name, which must
+// be a valid target (see validTarget). Definitions are read once and cached.
+// It returns an error wrapping fs.ErrNotExist if there is no such board.
+func (lib *partsLibrary) board(name string) (*partDefinition, error) {
+	lib.lock.Lock()
+	def, ok := lib.boards[name]
+	lib.lock.Unlock()
+	if ok {
+		return def, nil
+	}
+	if name == "parts" {
+		// parts/parts.json is the index, not a part definition.
+		return nil, fmt.Errorf("%s: %w", name, errNotABoard)
+	}
+	def, err := readPartDefinition(lib.fsys, "parts/"+name+".json")
+	if err != nil {
+		return nil, err
+	}
+	if !def.isBoard() {
+		return nil, fmt.Errorf("%s: %w", name, errNotABoard)
+	}
+	lib.lock.Lock()
+	lib.boards[name] = def
+	lib.lock.Unlock()
+	return def, nil
+}
+
+// validateParts checks parts/parts.json and all board and part definitions in
+// parts/*.json of the given frontend. It returns all problems found, sorted by
+// file.
+func validateParts(fsys fs.FS) ([]partsProblem, error) {
+	lib, err := loadPartsLibrary(fsys)
+	if err != nil {
+		return nil, err
+	}
+	var problems []partsProblem
+	report := func(file, field, code, format string, args ...any) {
+		problems = append(problems, partsProblem{file, field, code, fmt.Sprintf(format, args...)})
+	}
+
+	// Check the parts that can be added to a schematic.
+	const indexName = "parts/parts.json"
+	var index partsIndex
+	data, err := fs.ReadFile(fsys, indexName)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&index); err != nil {
+		report(indexName, "", "invalid-json", "%v", err)
+	}
+	for i, entry := range index.Parts {
+		field := fmt.Sprintf("parts[%d]", i)
+		if entry.Location != "" {
+			if !validPartLocation.MatchString(entry.Location) {
+				report(indexName, field+".location", "invalid-location", "invalid location %q", entry.Location)
+			} else if _, err := fs.Stat(fsys, entry.Location); err != nil {
+				report(indexName, field+".location", "missing-file", "%s does not exist", entry.Location)
+			}
+		} else if _, ok := partTypePins[entry.Config.Type]; !ok {
+			report(indexName, field+".config.type", "unknown-type", "unknown part type %q", entry.Config.Type)
+		}
+		if _, err := fs.Stat(fsys, entry.Config.SVG); err != nil {
+			report(indexName, field+".config.svg", "missing-file", "SVG %q does not exist", entry.Config.SVG)
+		}
+	}
+
+	// Check the board and part definitions.
+	names, err := fs.Glob(fsys, "parts/*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if name == indexName {
+			continue
+		}
+		def, err := readPartDefinition(fsys, name)
+		if err != nil {
+			report(name, "", "invalid-json", "%v", err)
+			continue
+		}
+		if want := strings.TrimSuffix(path.Base(name), ".json"); def.Name != want {
+			report(name, "name", "invalid-name", "name is %q, expected %q", def.Name, want)
+		}
+		if def.HumanName == "" {
+			report(name, "humanName", "missing-field", "humanName is not set")
+		}
+		if def.FirmwareFormat != "" && !slices.Contains(firmwareFormats, def.FirmwareFormat) {
+			report(name, "firmwareFormat", "invalid-firmware-format", "firmware format %q is not one of %s", def.FirmwareFormat, strings.Join(firmwareFormats, ", "))
+		}
+
+		// How to compile code for the board.
+		if !def.isBoard() && (def.Target != "" || def.SimulationTags != nil || def.FirmwareFormats != nil || def.DefaultFormat != "" || def.UF2FamilyID != "") {
+			report(name, "", "unexpected-field", "only boards (with a mainPart) have compile settings")
+		}
+		if def.Target != "" && !validTarget.MatchString(def.Target) {
+			report(name, "target", "invalid-target", "invalid target %q", def.Target)
+		}
+		for i, tag := range def.SimulationTags {
+			if !validBuildTag.MatchString(tag) {
+				report(name, fmt.Sprintf("simulationTags[%d]", i), "invalid-build-tag", "invalid build tag %q", tag)
+			}
+		}
+		for i, format := range def.FirmwareFormats {
+			if !slices.Contains(firmwareFormats, format) {
+				report(name, fmt.Sprintf("firmwareFormats[%d]", i), "invalid-firmware-format", "firmware format %q is not one of %s", format, strings.Join(firmwareFormats, ", "))
+			}
+		}
+		if def.FirmwareFormat != "" && !slices.Contains(def.supportedFirmwareFormats(), def.FirmwareFormat) {
+			report(name, "firmwareFormat", "unsupported-format", "firmware format %q is not in firmwareFormats", def.FirmwareFormat)
+		}
+		if def.UF2FamilyID != "" {
+			if _, err := def.uf2FamilyID(); err != nil {
+				report(name, "uf2FamilyID", "invalid-uf2-family-id", "invalid UF2 family ID %q", def.UF2FamilyID)
+			}
+		} else if slices.Contains(def.supportedFirmwareFormats(), "uf2") {
+			report(name, "uf2FamilyID", "missing-field", "uf2FamilyID is needed to build firmware in the uf2 format")
+		}
+		if format := def.DefaultFormat; format != "" && format != "wasm" && format != "wasi" && !slices.Contains(def.supportedFirmwareFormats(), format) {
+			report(name, "defaultFormat", "unsupported-format", "default format %q is not wasm, wasi or in firmwareFormats", format)
+		}
+
+		// Pins of the part itself, in its SVG.
+		pins := make(map[string]bool)
+		svgOK := true
+		for _, pin := range partPowerPins {
+			pins[pin] = true
+		}
+		if def.SVG != "" {
+			svgPath := path.Join(path.Dir(name), def.SVG)
+			var svgPins map[string]bool
+			if fs.ValidPath(svgPath) {
+				svgPins, err = lib.svgPins(svgPath)
+			} else {
+				err = fs.ErrNotExist
+			}
+			if errors.Is(err, fs.ErrNotExist) {
+				report(name, "svg", "missing-file", "SVG %q does not exist", def.SVG)
+			} else if err != nil {
+				report(name, "svg", "invalid-svg", "could not read SVG %q: %v", def.SVG, err)
+			}
+			svgOK = err == nil
+			for pin := range svgPins {
+				pins[pin] = true
+			}
+		}
+
+		// Pins of the subparts.
+		subpartPins := make(map[string]map[string]bool)
+		for i, part := range def.Parts {
+			field := fmt.Sprintf("parts[%d]", i)
+			if !validPartID.MatchString(part.ID) {
+				report(name, field+".id", "invalid-id", "invalid ID %q", part.ID)
+				continue
+			}
+			if _, ok := subpartPins[part.ID]; ok {
+				report(name, field+".id", "duplicate-id", "duplicate ID %q", part.ID)
+				continue
+			}
+			typePins, ok := partTypePins[part.Type]
+			if !ok {
+				report(name, field+".type", "unknown-type", "unknown part type %q", part.Type)
+			}
+			subpartPins[part.ID] = make(map[string]bool)
+			for _, pin := range typePins {
+				subpartPins[part.ID][pin] = true
+			}
+			if part.Pins != nil && part.Type != "mcu" {
+				report(name, field+".pins", "unexpected-field", "only parts of type mcu have a pin map")
+			}
+			numbers := make(map[int]string)
+			for _, pin := range sortedKeys(part.Pins) {
+				number := part.Pins[pin]
+				if number < 0 || number >= mcuNoPin {
+					report(name, field+".pins."+pin, "invalid-pin-number", "pin number %d is out of range", number)
+				} else if other, ok := numbers[number]; ok {
+					report(name, field+".pins."+pin, "duplicate-pin-number", "pin number %d is also used by %s", number, other)
+				}
+				numbers[number] = pin
+				subpartPins[part.ID][pin] = true
+			}
+		}
+		if def.MainPart != "" {
+			index := slices.IndexFunc(def.Parts, func(part subpartDefinition) bool { return part.ID == def.MainPart })
+			if index < 0 {
+				report(name, "mainPart", "unknown-part", "main part %q does not exist", def.MainPart)
+			} else if def.Parts[index].Type != "mcu" {
+				report(name, "mainPart", "invalid-main-part", "main part %q is not an mcu", def.MainPart)
+			}
+		}
+
+		// Wires connect pins of the part itself ("D13") and pins of subparts
+		// ("mcu.PB5").
+		for i, wire := range def.Wires {
+			for _, end := range []struct{ field, pin string }{{"from", wire.From}, {"to", wire.To}} {
+				field := fmt.Sprintf("wires[%d].%s", i, end.field)
+				partID, pin, isSubpart := strings.Cut(end.pin, ".")
+				if !isSubpart {
+					if svgOK && !pins[end.pin] { // don't repeat a problem with the SVG for every wire
+						report(name, field, "unknown-pin", "pin %q is not in the SVG", end.pin)
+					}
+					continue
+				}
+				subpart, ok := subpartPins[partID]
+				if !ok {
+					report(name, field, "unknown-part", "part %q does not exist", partID)
+				} else if !subpart[pin] {
+					report(name, field, "unknown-pin", "part %q has no pin %q", partID, pin)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].File < problems[j].File
+	})
+	return problems, nil
+}
+
+// sortedKeys returns the keys of the map in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validatePartsCommand runs the "validate-parts" subcommand. It validates the
+// parts of the frontend (see -dir), and writes the problems as JSON (one
+// object per line) or as text. It exits with status 1 if there are problems.
+func validatePartsCommand(args []string) {
+	flags := flag.NewFlagSet("validate-parts", flag.ExitOnError)
+	format := flags.String("format", "json", "output format (json, text)")
+	flags.Parse(args)
+	switch *format {
+	case "json", "text":
+	default:
+		fatal("unrecognized output format", "format", *format)
+	}
+
+	problems, err := validateParts(frontendFS())
+	if err != nil {
+		fatal("could not validate parts", "err", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, problem := range problems {
+		if *format == "json" {
+			encoder.Encode(problem)
+		} else {
+			fmt.Println(problem)
+		}
+	}
+	if len(problems) != 0 {
+		os.Exit(1)
+	}
+}
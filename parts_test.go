@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func TestPartsLibraryBoard(t *testing.T) {
+	lib, err := loadPartsLibrary(os.DirFS("."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"arduino", nil},
+		{"pico", nil},
+		{"arduino", nil}, // cached
+		{"adafruit-lis3dh", errNotABoard},
+		{"parts", errNotABoard}, // the index
+		{"nonexistent", fs.ErrNotExist},
+	} {
+		board, err := lib.board(tc.name)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s: got error %v, expected %v", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if !board.isBoard() {
+			t.Errorf("%s: not a board", tc.name)
+		}
+	}
+}
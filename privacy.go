@@ -0,0 +1,195 @@
+package main
+
+// This file implements the privacy controls: how IP addresses are stored in
+// shares and for how long, honoring opt-out headers for compile tracking, and
+// an export of the personal data that is stored.
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The salt used to hash IP addresses, replaced every day. It is only kept in
+// memory, so hashes can't be linked to an IP address once the day is over.
+var ipHashSalt struct {
+	lock sync.Mutex
+	day  string
+	salt []byte
+}
+
+// getStoredIP returns the IP address of the request as it should be stored in
+// a share, depending on conf.ShareIPMode:
+//
+//	obfuscated  the network of the address, like 192.0.2.0/24
+//	hash        a hash of the address, with a salt that changes every day
+//	none        the empty string
+func getStoredIP(r *http.Request, now time.Time) (string, error) {
+	switch conf.ShareIPMode {
+	case "none":
+		return "", nil
+	case "hash":
+		address, err := clientIP(r.Context())
+		if err != nil {
+			return "", err
+		}
+		return hashIP(address.String(), now), nil
+	default:
+		return getObfuscatedIP(r)
+	}
+}
+
+// hashIP returns a salted hash of the IP address. The same address results in
+// the same hash on a single day (in UTC) on a single server instance.
+func hashIP(address string, now time.Time) string {
+	day := now.UTC().Format(time.DateOnly)
+	ipHashSalt.lock.Lock()
+	if ipHashSalt.day != day {
+		ipHashSalt.day = day
+		ipHashSalt.salt = make([]byte, 32)
+		if _, err := rand.Read(ipHashSalt.salt); err != nil {
+			panic(err) // crypto/rand never fails on supported platforms
+		}
+	}
+	mac := hmac.New(sha256.New, ipHashSalt.salt)
+	ipHashSalt.lock.Unlock()
+	mac.Write([]byte(address))
+	return "hash:" + hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// stripShareIPs removes the IP address from all shares created before the
+// given time by listing all shares, and returns the number of shares that were
+// changed. It implements StripIPs for stores that have no index on the time.
+func stripShareIPs(ctx context.Context, store shareStore, before time.Time) (int, error) {
+	var old []*share
+	err := store.List(ctx, func(s *share) error {
+		if s.IP != "" && s.Time.Before(before) {
+			old = append(old, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, s := range old {
+		s.IP = ""
+		err := store.Update(ctx, s)
+		if err == errShareNotFound {
+			continue // deleted in the meantime
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// How often IP addresses older than the retention period are removed. Shares
+// keep their IP address for at most this much longer than the retention
+// period.
+const ipRetentionInterval = time.Hour
+
+// enforceIPRetention removes IP addresses older than the given number of days
+// from the share store every ipRetentionInterval, until the context is
+// cancelled. It runs independently of sweepExpiredShares, so that the
+// retention period also applies when expired shares are not swept.
+func enforceIPRetention(ctx context.Context, days int) {
+	ticker := time.NewTicker(ipRetentionInterval)
+	defer ticker.Stop()
+	for {
+		before := time.Now().AddDate(0, 0, -days)
+		n, err := shares.StripIPs(ctx, before)
+		if n != 0 {
+			slog.Info("removed IP addresses from shares", "count", n)
+		}
+		if err != nil && ctx.Err() == nil {
+			metricShareErrors.Inc("write")
+			slog.Error("could not remove IP addresses from shares", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// trackingOptOut returns whether the client asked not to be tracked, using
+// the Global Privacy Control (Sec-GPC) or Do Not Track (DNT) header.
+func trackingOptOut(r *http.Request) bool {
+	return r.Header.Get("Sec-GPC") == "1" || r.Header.Get("DNT") == "1"
+}
+
+// privacyRecord is a single line in the output of privacy-export.
+type privacyRecord struct {
+	ID       string     `json:"id"`
+	Time     time.Time  `json:"time"`
+	IP       string     `json:"ip,omitempty"`
+	HasOwner bool       `json:"hasOwner"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// privacyExport runs the "privacy-export" subcommand. It writes the metadata
+// that is stored about the person who created each share, as JSON lines.
+// Shared code itself is not included, see export-shares for that.
+func privacyExport(args []string) {
+	flags := flag.NewFlagSet("privacy-export", flag.ExitOnError)
+	output := flags.String("o", "-", "file to write to (- for stdout)")
+	ip := flags.String("ip", "", "only list shares with this stored IP address (as stored, for example 192.0.2.0/24)")
+	withIP := flags.Bool("with-ip", false, "only list shares that still have an IP address stored")
+	flags.Parse(args)
+
+	w := os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatal("could not create output file", "err", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	n, withIPs := 0, 0
+	err := shares.List(context.Background(), func(s *share) error {
+		if (*ip != "" && s.IP != *ip) || (*withIP && s.IP == "") {
+			return nil
+		}
+		n++
+		if s.IP != "" {
+			withIPs++
+		}
+		return encoder.Encode(privacyRecord{
+			ID:       s.ID,
+			Time:     s.Time,
+			IP:       s.IP,
+			HasOwner: slices.ContainsFunc(s.OwnerHashes, func(hash string) bool { return hash != "" }),
+			Expires:  s.Expires,
+		})
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		fatal("could not export shares", "err", err)
+	}
+	retention := "forever"
+	if conf.IPRetentionDays > 0 {
+		retention = fmt.Sprintf("%d days", conf.IPRetentionDays)
+	}
+	slog.Info("exported stored personal data", "shares", n, "with_ip", withIPs, "ip_mode", conf.ShareIPMode, "ip_retention", retention, "analytics_sink", conf.AnalyticsSink)
+}
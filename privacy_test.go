@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestGetStoredIP(t *testing.T) {
+	old := conf
+	t.Cleanup(func() { conf = old })
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	withClient := func(addr string, err error) context.Context {
+		client := clientAddr{Err: err}
+		if addr != "" {
+			client.Addr = netip.MustParseAddr(addr)
+		}
+		return context.WithValue(context.Background(), clientIPKey, client)
+	}
+	validHash := regexp.MustCompile(`^hash:[0-9a-f]{24}$`)
+
+	for _, tc := range []struct {
+		mode, addr string
+		stored     string // regexp
+	}{
+		{"obfuscated", "192.0.2.123", `^192\.0\.2\.0/24$`},
+		{"obfuscated", "2001:db8:1234:5678::1", `^2001:db8:1234::/48$`},
+		{"", "192.0.2.123", `^192\.0\.2\.0/24$`}, // default
+		{"hash", "192.0.2.123", validHash.String()},
+		{"hash", "2001:db8::1", validHash.String()},
+		{"none", "192.0.2.123", `^$`},
+	} {
+		conf.ShareIPMode = tc.mode
+		r := httptest.NewRequest("POST", "/api/share", nil).WithContext(withClient(tc.addr, nil))
+		stored, err := getStoredIP(r, now)
+		if err != nil {
+			t.Errorf("%s %s: %v", tc.mode, tc.addr, err)
+			continue
+		}
+		if !regexp.MustCompile(tc.stored).MatchString(stored) {
+			t.Errorf("%s %s: stored %q, expected %s", tc.mode, tc.addr, stored, tc.stored)
+		}
+	}
+
+	// Without a client address, the share can't be stored unless no address
+	// is stored at all.
+	unknown := httptest.NewRequest("POST", "/api/share", nil).WithContext(withClient("", errors.New("unknown client")))
+	for mode, ok := range map[string]bool{"obfuscated": false, "hash": false, "none": true} {
+		conf.ShareIPMode = mode
+		if _, err := getStoredIP(unknown, now); (err == nil) != ok {
+			t.Errorf("%s without client address: got error %v", mode, err)
+		}
+	}
+}
+
+func TestHashIP(t *testing.T) {
+	day1 := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	a := hashIP("192.0.2.1", day1)
+	if b := hashIP("192.0.2.1", day1.Add(23*time.Hour)); a != b {
+		t.Errorf("hash changed on the same day: %s, %s", a, b)
+	}
+	if b := hashIP("192.0.2.2", day1); a == b {
+		t.Errorf("different addresses have the same hash %s", a)
+	}
+	// The day is in UTC, regardless of the time zone of the given time.
+	if b := hashIP("192.0.2.1", day1.Add(12*time.Hour).In(time.FixedZone("UTC-14", -14*60*60))); a != b {
+		t.Errorf("hash depends on the time zone: %s, %s", a, b)
+	}
+
+	// A new salt is used every day, so hashes can't be linked across days.
+	day2 := day1.AddDate(0, 0, 1)
+	next := hashIP("192.0.2.1", day2)
+	if next == a {
+		t.Errorf("hash is the same on the next day: %s", a)
+	}
+	if again := hashIP("192.0.2.1", day1); again == a {
+		t.Errorf("hash of an earlier day can be recreated: %s", a)
+	}
+}
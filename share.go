@@ -0,0 +1,907 @@
+package main
+
+// This file implements sharing snippets (code and schematic) through the
+// /api/share endpoint, independent of where the shares are stored.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errShareNotFound = errors.New("share not found")
+	errShareExists   = errors.New("share already exists")
+)
+
+// share is a single shared snippet, with some metadata.
+type share struct {
+	ID       string    `json:"id"`
+	Parent   string    `json:"parent,omitempty"` // share this one was forked from
+	Revision int       `json:"revision"`         // 1 for new shares, parent revision + 1 for forks
+	Time     time.Time `json:"time"`             // creation time, rounded to a single minute
+	IP       string    `json:"ip"`               // obfuscated or hashed IP address, see getStoredIP
+	Data     any       `json:"data"`             // JSON data as sent by the client
+
+	// Hashes of the owner tokens, which allow updating and deleting the
+	// share: one for everyone who shared this snippet, as identical snippets
+	// get the same ID. The share is deleted when its last owner deletes it.
+	// Shares stored before owner tokens were introduced have no owners. If
+	// someone shares such a snippet again, an empty hash is added for the
+	// unknown original owner so that the share is never deleted or changed.
+	OwnerHashes []string `json:"ownerHashes,omitempty"`
+
+	// Time after which the share is deleted, or nil to keep it forever.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// shareInfo is the metadata of a share that is public, as returned by the
+// history and forks endpoints.
+type shareInfo struct {
+	ID       string    `json:"id"`
+	Parent   string    `json:"parent,omitempty"`
+	Revision int       `json:"revision"`
+	Time     time.Time `json:"time"`
+}
+
+func (s *share) info() shareInfo {
+	return shareInfo{
+		ID:       s.ID,
+		Parent:   s.Parent,
+		Revision: s.revision(),
+		Time:     s.Time,
+	}
+}
+
+// expired returns whether the share has expired at the given time.
+func (s *share) expired(now time.Time) bool {
+	return s.Expires != nil && !now.Before(*s.Expires)
+}
+
+// ownedBy returns whether the owner token with the given hash is one of the
+// owner tokens of the share.
+func (s *share) ownedBy(tokenHash string) bool {
+	owned := false
+	for _, hash := range s.OwnerHashes {
+		if subtle.ConstantTimeCompare([]byte(tokenHash), []byte(hash)) == 1 {
+			owned = true
+		}
+	}
+	return owned
+}
+
+// addOwner adds an owner token hash to a share that already exists. If the
+// share was stored before owner tokens were introduced, its unknown original
+// owner is kept as an empty hash.
+func (s *share) addOwner(tokenHash string) {
+	if slices.Contains(s.OwnerHashes, tokenHash) {
+		return
+	}
+	if len(s.OwnerHashes) == 0 {
+		s.OwnerHashes = []string{""}
+	}
+	s.OwnerHashes = append(s.OwnerHashes, tokenHash)
+}
+
+// removeOwner removes an owner token hash from the share.
+func (s *share) removeOwner(tokenHash string) {
+	s.OwnerHashes = slices.DeleteFunc(s.OwnerHashes, func(hash string) bool {
+		return hash == tokenHash
+	})
+}
+
+// revision returns the revision of the share. Shares stored before revisions
+// were introduced count as revision 1.
+func (s *share) revision() int {
+	return max(s.Revision, 1)
+}
+
+// Maximum number of ancestors returned by the history endpoint.
+const maxShareHistory = 1000
+
+// getShare returns the share with the given ID. Shares that have expired but
+// weren't removed by the sweeper yet are reported as not found.
+func getShare(ctx context.Context, id string) (*share, error) {
+	s, err := shares.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if s.expired(time.Now()) {
+		return nil, errShareNotFound
+	}
+	return s, nil
+}
+
+// parseShareTTL parses the time a share should be kept: "forever" (or empty),
+// a number of days like "30d", or a Go duration like "12h". It returns the
+// expiry time, or nil if the share should be kept forever.
+func parseShareTTL(value string, now time.Time) (*time.Time, error) {
+	var ttl time.Duration
+	switch {
+	case value == "" || value == "forever":
+		return nil, nil
+	case strings.HasSuffix(value, "d"):
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL %q", value)
+		}
+		ttl = time.Duration(days) * 24 * time.Hour
+	default:
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL %q", value)
+		}
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid TTL %q", value)
+	}
+	expires := now.Add(ttl).UTC()
+	return &expires, nil
+}
+
+// newOwnerToken returns a new random owner token, and the hash of the token
+// that is stored with the share.
+func newOwnerToken() (token, hash string) {
+	var buf [32]byte
+	rand.Read(buf[:])
+	token = hex.EncodeToString(buf[:])
+	return token, ownerTokenHash(token)
+}
+
+// ownerTokenHash returns the hash of an owner token, as stored in a share.
+func ownerTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// shareStore is a storage backend for shared snippets.
+type shareStore interface {
+	// Get returns the share with the given ID, or errShareNotFound.
+	Get(ctx context.Context, id string) (*share, error)
+
+	// Create stores a new share. It returns errShareExists if a share with
+	// the same ID already exists.
+	Create(ctx context.Context, s *share) error
+
+	// List calls fn for every stored share, until fn returns an error.
+	List(ctx context.Context, fn func(*share) error) error
+
+	// Update replaces an existing share. It returns errShareNotFound if there
+	// is no share with the same ID.
+	Update(ctx context.Context, s *share) error
+
+	// Delete removes the share with the given ID, or returns
+	// errShareNotFound.
+	Delete(ctx context.Context, id string) error
+
+	// Modify atomically changes the share with the given ID: fn is called
+	// with the stored share and may change it, or return nil to delete it.
+	// If fn returns an error, the share is left unchanged and Modify returns
+	// that error. Modify returns errShareNotFound if there is no such share.
+	// fn may be called more than once, if the share was changed in the
+	// meantime.
+	Modify(ctx context.Context, id string, fn func(*share) (*share, error)) error
+
+	// DeleteExpired removes all shares that expired before the given time,
+	// and returns how many were removed.
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+
+	// StripIPs removes the IP address from all shares created before the
+	// given time, and returns how many were changed.
+	StripIPs(ctx context.Context, before time.Time) (int, error)
+
+	// Forks returns all shares with the given share as parent.
+	Forks(ctx context.Context, parent string) ([]*share, error)
+
+	// Close releases all resources held by the store.
+	Close() error
+}
+
+// The share store configured for this server.
+var shares shareStore
+
+// openShareStore opens the share store of the given type ("firestore",
+// "file", "bolt" or "memory"). The path is the directory (for "file") or
+// database file (for "bolt") to store shares in.
+func openShareStore(storage, path string) (shareStore, error) {
+	switch storage {
+	case "firestore":
+		return &firestoreShareStore{}, nil
+	case "file":
+		return newFileShareStore(path)
+	case "bolt":
+		return newBoltShareStore(path)
+	case "memory":
+		return newMemoryShareStore(), nil
+	default:
+		return nil, fmt.Errorf("unrecognized share storage: %s", storage)
+	}
+}
+
+// Length of new share IDs. Longer IDs are only used when two different
+// snippets hash to the same short ID.
+const shareIDLength = 10
+
+// canonicalShareData returns the canonical JSON encoding of the shared data,
+// so that the same snippet always results in the same bytes: object keys are
+// sorted and insignificant whitespace is removed.
+func canonicalShareData(data any) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+// shareIDHash returns the hash of the canonical data and the parent it was
+// forked from, in base62. Share IDs are a prefix of this hash. Including the
+// parent keeps the lineage of forks: an unchanged fork gets its own ID instead
+// of the ID of its parent, and forks of different shares with the same
+// contents get different IDs. Shares without a parent hash only the data, so
+// their IDs are the same as before forks were tracked.
+func shareIDHash(parent string, canonical []byte) string {
+	h := sha256.New()
+	if parent != "" {
+		h.Write([]byte("parent:" + parent + "\n"))
+	}
+	h.Write(canonical)
+	return new(big.Int).SetBytes(h.Sum(nil)).Text(62)
+}
+
+// createShare stores the shared data under an ID derived from its contents
+// and parent, and returns the ID. If the same data was shared before with the
+// same parent, the existing share is reused and created is false: the owner of
+// the new share is added to its owners, and it is kept at least as long as
+// requested. If a different snippet already uses the short ID, a longer
+// prefix of the hash is used instead.
+func createShare(ctx context.Context, s *share) (id string, created bool, err error) {
+	canonical, err := canonicalShareData(s.Data)
+	if err != nil {
+		return "", false, err
+	}
+	hash := shareIDHash(s.Parent, canonical)
+	for length := shareIDLength; length <= len(hash); length++ {
+		s.ID = hash[:length]
+		err := shares.Create(ctx, s)
+		if err == nil {
+			return s.ID, true, nil
+		}
+		if err != errShareExists {
+			return "", false, err
+		}
+		expired := false
+		err = shares.Modify(ctx, s.ID, func(existing *share) (*share, error) {
+			expired = false
+			if existing.expired(time.Now()) {
+				// Not yet removed by the sweeper, so remove it now.
+				expired = true
+				return nil, nil
+			}
+			existingCanonical, err := canonicalShareData(existing.Data)
+			if err != nil {
+				return nil, err
+			}
+			if existing.Parent != s.Parent || !bytes.Equal(canonical, existingCanonical) {
+				return nil, errShareExists // a different snippet
+			}
+			// Shared before: add the new owner and keep the share at least
+			// as long as requested now.
+			for _, tokenHash := range s.OwnerHashes {
+				existing.addOwner(tokenHash)
+			}
+			if existing.Expires != nil && (s.Expires == nil || s.Expires.After(*existing.Expires)) {
+				existing.Expires = s.Expires
+			}
+			return existing, nil
+		})
+		if err == errShareNotFound || expired {
+			// Deleted in the meantime, or just now because it expired.
+			length--
+			continue
+		}
+		if err == errShareExists {
+			logger(ctx).Warn("share ID collision", "id", s.ID)
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return s.ID, false, nil
+	}
+	return "", false, errors.New("could not find a free share ID")
+}
+
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == "GET" {
+		id := r.FormValue("id")
+		if id == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("no ID supplied"))
+			return
+		}
+
+		s, err := getShare(r.Context(), id)
+		if err == errShareNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("ID not found"))
+			return
+		}
+		if err != nil {
+			metricShareErrors.Inc("read")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("could not fetch shared data"))
+			logger(r.Context()).Error("could not fetch shared data", "id", id, "err", err)
+			return
+		}
+		metricShareReads.Inc()
+		data, err := json.Marshal(map[string]any{
+			"data": s.Data,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("could not serialize shared data"))
+			logger(r.Context()).Error("could not serialize shared data", "id", id, "err", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	} else if r.Method == "POST" {
+		data, ok := readShareData(w, r)
+		if !ok {
+			return
+		}
+		expires, err := parseShareTTL(r.URL.Query().Get("ttl"), time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		// Link the share to the share it was forked from, if any.
+		revision := 1
+		parent := r.URL.Query().Get("parent")
+		if parent != "" {
+			p, err := getShare(r.Context(), parent)
+			if err == errShareNotFound {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte("parent not found"))
+				return
+			}
+			if err != nil {
+				metricShareErrors.Inc("read")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("could not fetch parent"))
+				logger(r.Context()).Error("could not fetch parent share", "parent", parent, "err", err)
+				return
+			}
+			revision = p.revision() + 1
+		}
+
+		// Read IP address, but make it less precise (or don't store it at
+		// all, depending on the configuration).
+		storedIP, err := getStoredIP(r, time.Now())
+		if err != nil {
+			// Not fatal: the share just won't have an IP address.
+			logger(r.Context()).Warn("could not determine client IP address", "err", err)
+		}
+
+		token, tokenHash := newOwnerToken()
+		s := &share{
+			Parent:   parent,
+			Revision: revision,
+			// Use a RFC3339 formatted timestamp, rounded to a single minute.
+			Time:        time.Now().UTC().Round(time.Minute),
+			IP:          storedIP,
+			Data:        data,
+			OwnerHashes: []string{tokenHash},
+			Expires:     expires,
+		}
+		id, _, err := createShare(r.Context(), s)
+		if err != nil {
+			metricShareErrors.Inc("write")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("could not store data"))
+			logger(r.Context()).Error("could not store shared data", "err", err)
+			return
+		}
+
+		metricShareWrites.Inc()
+
+		// Return the ID, and the owner token that allows updating and deleting
+		// the share. Everyone who shares the same snippet gets their own
+		// token.
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"id":    id,
+			"token": token,
+		})
+	}
+}
+
+// readShareData reads and validates the shared state in the request body. If
+// it isn't valid, it writes an error response and returns false.
+func readShareData(w http.ResponseWriter, r *http.Request) (any, bool) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		w.Write([]byte("expected application/json data"))
+		return nil, false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, conf.MaxShareSize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("shared data too large"))
+		return nil, false
+	}
+	var data any
+	if err := json.Unmarshal(body, &data); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("could not parse JSON"))
+		return nil, false
+	}
+
+	// Only store schematics that the frontend can load.
+	lib, err := getPartsLibrary()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not load parts library"))
+		logger(r.Context()).Error("could not load parts library", "err", err)
+		return nil, false
+	}
+	if _, problems := parseShareState(body, lib); problems != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("invalid share:\n" + strings.Join(problems, "\n") + "\n"))
+		return nil, false
+	}
+	return data, true
+}
+
+var (
+	errNotShareOwner  = errors.New("invalid owner token")
+	errSharedByOthers = errors.New("share has other owners")
+)
+
+// handleShareID handles updating (PUT) and deleting (DELETE) a single share
+// at /api/share/{id}. Both need the owner token returned when the share was
+// created, as a bearer token in the Authorization header.
+//
+// As identical snippets get the same ID, a share may have several owners.
+// Deleting such a share only removes the owner, the share is deleted along
+// with its last owner. Updating it moves the new version to a new share for
+// the owner, so the others keep the snippet they shared; the response
+// contains the new ID.
+func handleShareID(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "PUT, DELETE")
+
+	switch r.Method {
+	case "OPTIONS":
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "PUT", "DELETE":
+	default:
+		w.Header().Set("Allow", "PUT, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	s, err := getShare(r.Context(), id)
+	if err == errShareNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("ID not found"))
+		return
+	}
+	if err != nil {
+		metricShareErrors.Inc("read")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not fetch shared data"))
+		logger(r.Context()).Error("could not fetch shared data", "id", id, "err", err)
+		return
+	}
+
+	// Check the owner token.
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("owner token required"))
+		return
+	}
+	tokenHash := ownerTokenHash(token)
+	if !s.ownedBy(tokenHash) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid owner token"))
+		return
+	}
+
+	if r.Method == "DELETE" {
+		deleted := false
+		err := shares.Modify(r.Context(), id, func(s *share) (*share, error) {
+			if !s.ownedBy(tokenHash) {
+				return nil, errNotShareOwner
+			}
+			s.removeOwner(tokenHash)
+			deleted = len(s.OwnerHashes) == 0
+			if deleted {
+				return nil, nil
+			}
+			return s, nil
+		})
+		if err == errShareNotFound || err == errNotShareOwner {
+			// Deleted in the meantime, by the same owner.
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("ID not found"))
+			return
+		}
+		if err != nil {
+			metricShareErrors.Inc("delete")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("could not delete share"))
+			logger(r.Context()).Error("could not delete share", "id", id, "err", err)
+			return
+		}
+		if deleted {
+			metricShareDeletes.Inc("owner")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Replace the shared data, and optionally the TTL.
+	data, ok := readShareData(w, r)
+	if !ok {
+		return
+	}
+	expires := s.Expires
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		expires, err = parseShareTTL(ttl, time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	newID, err := updateShare(r, id, tokenHash, data, expires)
+	if err == errShareNotFound || err == errNotShareOwner {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("ID not found"))
+		return
+	}
+	if err != nil {
+		metricShareErrors.Inc("write")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not store data"))
+		logger(r.Context()).Error("could not update shared data", "id", id, "err", err)
+		return
+	}
+	metricShareWrites.Inc()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id": newID,
+	})
+}
+
+// updateShare replaces the data of the share with the given ID for the owner
+// with the given token hash, and returns the ID of the updated share. If the
+// owner is the only owner, the share is changed in place and keeps its ID.
+// Otherwise, the owner is removed from the share and the new data is stored
+// as a new share (with the same parent), so the other owners keep the snippet
+// they shared.
+func updateShare(r *http.Request, id, tokenHash string, data any, expires *time.Time) (string, error) {
+	ctx := r.Context()
+	var old share
+	err := shares.Modify(ctx, id, func(s *share) (*share, error) {
+		if !s.ownedBy(tokenHash) {
+			return nil, errNotShareOwner
+		}
+		if len(s.OwnerHashes) != 1 {
+			old = *s
+			return nil, errSharedByOthers
+		}
+		s.Data = data
+		s.Expires = expires
+		return s, nil
+	})
+	if err != errSharedByOthers {
+		return id, err
+	}
+
+	storedIP, err := getStoredIP(r, time.Now())
+	if err != nil {
+		logger(ctx).Warn("could not determine client IP address", "err", err)
+	}
+	newID, _, err := createShare(ctx, &share{
+		Parent:      old.Parent,
+		Revision:    old.revision(),
+		Time:        time.Now().UTC().Round(time.Minute),
+		IP:          storedIP,
+		Data:        data,
+		OwnerHashes: []string{tokenHash},
+		Expires:     expires,
+	})
+	if err != nil {
+		return "", err
+	}
+	if newID == id {
+		// The data didn't change.
+		return id, nil
+	}
+	err = shares.Modify(ctx, id, func(s *share) (*share, error) {
+		s.removeOwner(tokenHash)
+		if len(s.OwnerHashes) == 0 {
+			return nil, nil
+		}
+		return s, nil
+	})
+	if err != nil && err != errShareNotFound {
+		return "", err
+	}
+	return newID, nil
+}
+
+// handleShareHistory handles GET /api/share/{id}/history. It returns the
+// share and all its ancestors, starting with the share itself.
+func handleShareHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	history := []shareInfo{}
+	seen := make(map[string]bool)
+	id := r.PathValue("id")
+	for id != "" && len(history) < maxShareHistory && !seen[id] {
+		s, err := getShare(r.Context(), id)
+		if err == errShareNotFound && len(history) != 0 {
+			break // parent was removed
+		}
+		if err == errShareNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("ID not found"))
+			return
+		}
+		if err != nil {
+			metricShareErrors.Inc("read")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("could not fetch share history"))
+			logger(r.Context()).Error("could not fetch share history", "id", id, "err", err)
+			return
+		}
+		seen[id] = true
+		history = append(history, s.info())
+		id = s.Parent
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"history": history,
+	})
+}
+
+// handleShareForks handles GET /api/share/{id}/forks. It returns all shares
+// that were forked directly from the given share, oldest first.
+func handleShareForks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	id := r.PathValue("id")
+	_, err := getShare(r.Context(), id)
+	if err == errShareNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("ID not found"))
+		return
+	}
+	var children []*share
+	if err == nil {
+		children, err = shares.Forks(r.Context(), id)
+	}
+	if err != nil {
+		metricShareErrors.Inc("read")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not fetch forks"))
+		logger(r.Context()).Error("could not fetch forks", "id", id, "err", err)
+		return
+	}
+
+	forks := []shareInfo{}
+	now := time.Now()
+	for _, child := range children {
+		if child.expired(now) {
+			continue
+		}
+		forks = append(forks, child.info())
+	}
+	sort.Slice(forks, func(i, j int) bool {
+		if !forks[i].Time.Equal(forks[j].Time) {
+			return forks[i].Time.Before(forks[j].Time)
+		}
+		return forks[i].ID < forks[j].ID
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"forks": forks,
+	})
+}
+
+// listForks returns the forks of the given share by listing all shares. It
+// implements Forks for stores that have no index on the parent.
+func listForks(ctx context.Context, store shareStore, parent string) ([]*share, error) {
+	var forks []*share
+	err := store.List(ctx, func(s *share) error {
+		if s.Parent == parent {
+			forks = append(forks, s)
+		}
+		return nil
+	})
+	return forks, err
+}
+
+// deleteExpiredShares removes expired shares by listing all shares. It
+// implements DeleteExpired for stores that have no index on the expiry time.
+func deleteExpiredShares(ctx context.Context, store shareStore, now time.Time) (int, error) {
+	var expired []string
+	err := store.List(ctx, func(s *share) error {
+		if s.expired(now) {
+			expired = append(expired, s.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range expired {
+		err := store.Delete(ctx, id)
+		if err == errShareNotFound {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// sweepExpiredShares removes expired shares from the share store every
+// interval, until the context is cancelled.
+func sweepExpiredShares(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := shares.DeleteExpired(ctx, time.Now())
+		if n != 0 {
+			metricShareDeletes.Add(float64(n), "expired")
+			slog.Info("deleted expired shares", "count", n)
+		}
+		if err != nil && ctx.Err() == nil {
+			metricShareErrors.Inc("delete")
+			slog.Error("could not delete expired shares", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Obtain an obfuscated IP address, with the last bits removed to preserve
+// privacy.
+func getObfuscatedIP(r *http.Request) (string, error) {
+	address, err := clientIP(r.Context())
+	if err != nil {
+		return "", err
+	}
+	return obfuscateIP(address), nil
+}
+
+// obfuscateIP returns the network of the IP address, with the last bits
+// removed to preserve privacy.
+func obfuscateIP(address netip.Addr) string {
+	if address.Is4() {
+		// clear last octet
+		ip := address.As4()
+		ip[3] = 0
+		return netip.AddrFrom4(ip).String() + "/24"
+	} else { // IPv6
+		// Zero all but the first 3 octets, to make it a /48 address.
+		// We might want to consider redacting the address a bit more, since
+		// this still identifies a single ISP customer.
+		ip := address.As16()
+		for i := 6; i < 16; i++ {
+			ip[i] = 0
+		}
+		return netip.AddrFrom16(ip).String() + "/48"
+	}
+}
+
+// exportShares runs the "export-shares" subcommand. It writes all shares in
+// the configured share store as JSON lines, to be read by import-shares.
+func exportShares(args []string) {
+	flags := flag.NewFlagSet("export-shares", flag.ExitOnError)
+	output := flags.String("o", "-", "file to write to (- for stdout)")
+	flags.Parse(args)
+
+	w := os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatal("could not create output file", "err", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	n := 0
+	err := shares.List(context.Background(), func(s *share) error {
+		n++
+		return encoder.Encode(s)
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		fatal("could not export shares", "err", err)
+	}
+	slog.Info("exported shares", "count", n)
+}
+
+// importShares runs the "import-shares" subcommand. It reads shares written
+// by export-shares and stores them in the configured share store. Shares that
+// already exist are skipped.
+func importShares(args []string) {
+	flags := flag.NewFlagSet("import-shares", flag.ExitOnError)
+	input := flags.String("i", "-", "file to read from (- for stdin)")
+	flags.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			fatal("could not open input file", "err", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	imported, skipped := 0, 0
+	for {
+		var s share
+		err := decoder.Decode(&s)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatal("could not read shares", "err", err)
+		}
+		err = shares.Create(context.Background(), &s)
+		if err == errShareExists {
+			skipped++
+			continue
+		}
+		if err != nil {
+			fatal("could not import share", "id", s.ID, "err", err)
+		}
+		imported++
+	}
+	slog.Info("imported shares", "imported", imported, "skipped", skipped)
+}
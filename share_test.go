@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useMemoryShares replaces the configured share store with an empty memory
+// store for the duration of the test.
+func useMemoryShares(t *testing.T) *memoryShareStore {
+	t.Helper()
+	store := newMemoryShareStore()
+	old := shares
+	shares = store
+	t.Cleanup(func() { shares = old })
+	return store
+}
+
+func mustParseJSON(t *testing.T, s string) any {
+	t.Helper()
+	var data any
+	if err := json.Unmarshal([]byte(s), &data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCanonicalShareData(t *testing.T) {
+	a, err := canonicalShareData(mustParseJSON(t, `{"b": [1, 2], "a": {"y": true, "x": null}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := canonicalShareData(mustParseJSON(t, "{\"a\":{\"x\":null,\"y\":true},\n\"b\":[1,2]}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(a) != string(b) {
+		t.Errorf("canonical data differs:\n%s\n%s", a, b)
+	}
+	if want := `{"a":{"x":null,"y":true},"b":[1,2]}`; string(a) != want {
+		t.Errorf("canonical data is %s, expected %s", a, want)
+	}
+}
+
+func TestCreateShareDedup(t *testing.T) {
+	ctx := context.Background()
+	useMemoryShares(t)
+
+	id, created, err := createShare(ctx, &share{Data: mustParseJSON(t, `{"code":"a","b":1}`)})
+	if err != nil || !created {
+		t.Fatalf("first share: created=%v err=%v", created, err)
+	}
+	if len(id) != shareIDLength {
+		t.Errorf("ID %q has length %d, expected %d", id, len(id), shareIDLength)
+	}
+
+	// The same data, with a different key order, gets the same ID.
+	id2, created, err := createShare(ctx, &share{Data: mustParseJSON(t, `{"b":1, "code":"a"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id2 != id || created {
+		t.Errorf("identical share: got %q created=%v, expected %q created=false", id2, created, id)
+	}
+
+	// Different data gets a different ID.
+	id3, created, err := createShare(ctx, &share{Data: mustParseJSON(t, `{"code":"b"}`)})
+	if err != nil || !created || id3 == id {
+		t.Errorf("different share: got %q created=%v err=%v", id3, created, err)
+	}
+}
+
+func TestCreateShareForks(t *testing.T) {
+	ctx := context.Background()
+	store := useMemoryShares(t)
+
+	parent, _, err := createShare(ctx, &share{Revision: 1, Data: "same"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := createShare(ctx, &share{Revision: 1, Data: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An unchanged fork is a new share, linked to its parent.
+	fork, created, err := createShare(ctx, &share{Parent: parent, Revision: 2, Data: "same"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fork == parent || !created {
+		t.Fatalf("unchanged fork: got %q created=%v, expected a new share", fork, created)
+	}
+	forks, err := store.Forks(ctx, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forks) != 1 || forks[0].ID != fork || forks[0].Revision != 2 {
+		t.Errorf("forks of parent: %+v, expected only %s at revision 2", forks, fork)
+	}
+
+	// Forking again with the same contents reuses the fork.
+	again, created, err := createShare(ctx, &share{Parent: parent, Revision: 2, Data: "same"})
+	if err != nil || again != fork || created {
+		t.Errorf("repeated fork: got %q created=%v err=%v, expected %q", again, created, err, fork)
+	}
+
+	// A fork with the contents of an unrelated share doesn't get its ID.
+	fork2, created, err := createShare(ctx, &share{Parent: parent, Revision: 2, Data: "other"})
+	if err != nil || fork2 == other || !created {
+		t.Errorf("fork matching unrelated share: got %q created=%v err=%v", fork2, created, err)
+	}
+}
+
+func TestCreateShareCollision(t *testing.T) {
+	ctx := context.Background()
+	store := useMemoryShares(t)
+
+	// Occupy the short ID of the data with a different snippet.
+	canonical, err := canonicalShareData("snippet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := shareIDHash("", canonical)
+	if err := store.Create(ctx, &share{ID: hash[:shareIDLength], Data: "squatter"}); err != nil {
+		t.Fatal(err)
+	}
+	id, created, err := createShare(ctx, &share{Data: "snippet"})
+	if err != nil || !created {
+		t.Fatalf("created=%v err=%v", created, err)
+	}
+	if id != hash[:shareIDLength+1] {
+		t.Errorf("got ID %q, expected the longer prefix %q", id, hash[:shareIDLength+1])
+	}
+
+	// An expired share using the ID is replaced.
+	expired := time.Now().Add(-time.Hour)
+	canonical, _ = canonicalShareData("fresh")
+	short := shareIDHash("", canonical)[:shareIDLength]
+	if err := store.Create(ctx, &share{ID: short, Data: "stale", Expires: &expired}); err != nil {
+		t.Fatal(err)
+	}
+	id, created, err = createShare(ctx, &share{Data: "fresh"})
+	if err != nil || !created || id != short {
+		t.Errorf("got %q created=%v err=%v, expected %q to be replaced", id, created, err, short)
+	}
+}
+
+// shareRequest calls the share API handlers with the given owner token (if
+// any) and JSON body (if any), and returns the response.
+func shareRequest(t *testing.T, method, target, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	if id, ok := strings.CutPrefix(r.URL.Path, "/api/share/"); ok {
+		r.SetPathValue("id", id)
+		handleShareID(w, r)
+	} else {
+		handleShare(w, r)
+	}
+	return w
+}
+
+// useShareConfig sets the configuration needed to create shares through the
+// API for the duration of the test.
+func useShareConfig(t *testing.T) {
+	old := conf
+	t.Cleanup(func() { conf = old })
+	conf.MaxShareSize = 10 * 1024
+	conf.ShareIPMode = "none"
+}
+
+// postShare shares the given snippet and returns the ID and owner token.
+func postShare(t *testing.T, body string) (id, token string) {
+	t.Helper()
+	w := shareRequest(t, "POST", "/api/share", "", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: status %d (%s)", w.Code, w.Body)
+	}
+	var response struct{ ID, Token string }
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.ID == "" || response.Token == "" {
+		t.Fatalf("POST: unexpected response %s", w.Body)
+	}
+	return response.ID, response.Token
+}
+
+func testSnippet(code string) string {
+	return `{"code": "` + code + `", "parts": [{"id": "main", "location": "parts/arduino.json", "x": 0, "y": 0}], "wires": []}`
+}
+
+func TestShareOwnerToken(t *testing.T) {
+	ctx := context.Background()
+	store := useMemoryShares(t)
+	token, tokenHash := newOwnerToken()
+	if len(token) != 64 || tokenHash != ownerTokenHash(token) || tokenHash == token {
+		t.Fatalf("unexpected token %q with hash %q", token, tokenHash)
+	}
+	if err := store.Create(ctx, &share{ID: "owned", Data: "a", OwnerHashes: []string{tokenHash}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(ctx, &share{ID: "legacy", Data: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	otherToken, _ := newOwnerToken()
+
+	for _, tc := range []struct {
+		method, id, auth string
+		status           int
+	}{
+		{"PATCH", "owned", "Bearer " + token, http.StatusMethodNotAllowed},
+		{"DELETE", "missing", "Bearer " + token, http.StatusNotFound},
+		{"PUT", "missing", "Bearer " + token, http.StatusNotFound},
+		{"DELETE", "owned", "", http.StatusUnauthorized},
+		{"PUT", "owned", "", http.StatusUnauthorized},
+		{"DELETE", "owned", token, http.StatusUnauthorized}, // no "Bearer" prefix
+		{"DELETE", "owned", "Bearer " + otherToken, http.StatusForbidden},
+		{"PUT", "owned", "Bearer " + otherToken, http.StatusForbidden},
+		{"DELETE", "owned", "Bearer " + tokenHash, http.StatusForbidden}, // the stored hash isn't a token
+		{"DELETE", "legacy", "Bearer " + token, http.StatusForbidden},    // no owner
+		{"DELETE", "owned", "Bearer " + token, http.StatusNoContent},
+		{"DELETE", "owned", "Bearer " + token, http.StatusNotFound}, // already deleted
+	} {
+		r := httptest.NewRequest(tc.method, "/api/share/"+tc.id, nil)
+		r.SetPathValue("id", tc.id)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		handleShareID(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s %s with %q: status %d, expected %d (%s)", tc.method, tc.id, tc.auth, w.Code, tc.status, w.Body)
+		}
+	}
+	if _, err := store.Get(ctx, "legacy"); err != nil {
+		t.Errorf("legacy share: %v", err)
+	}
+}
+
+func TestShareSeveralOwners(t *testing.T) {
+	ctx := context.Background()
+	store := useMemoryShares(t)
+	useShareConfig(t)
+
+	// Everyone sharing the same snippet gets their own token.
+	id, token1 := postShare(t, testSnippet("a"))
+	id2, token2 := postShare(t, testSnippet("a"))
+	if id2 != id || token2 == token1 {
+		t.Fatalf("second share: got %q with token %q, expected %q with a new token", id2, token2, id)
+	}
+
+	// Deleting removes only that owner, until the last one deletes it.
+	if w := shareRequest(t, "DELETE", "/api/share/"+id, token1, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("first DELETE: status %d (%s)", w.Code, w.Body)
+	}
+	if _, err := store.Get(ctx, id); err != nil {
+		t.Errorf("share deleted while it still has an owner: %v", err)
+	}
+	if w := shareRequest(t, "DELETE", "/api/share/"+id, token1, ""); w.Code != http.StatusForbidden {
+		t.Errorf("repeated DELETE: status %d, expected %d", w.Code, http.StatusForbidden)
+	}
+	if w := shareRequest(t, "DELETE", "/api/share/"+id, token2, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("second DELETE: status %d (%s)", w.Code, w.Body)
+	}
+	if _, err := store.Get(ctx, id); err != errShareNotFound {
+		t.Errorf("share not deleted by its last owner: %v", err)
+	}
+
+	// Sharing a snippet stored before owner tokens doesn't allow anyone to
+	// delete it.
+	canonical, err := canonicalShareData(mustParseJSON(t, testSnippet("legacy")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyID := shareIDHash("", canonical)[:shareIDLength]
+	if err := store.Create(ctx, &share{ID: legacyID, Data: mustParseJSON(t, testSnippet("legacy"))}); err != nil {
+		t.Fatal(err)
+	}
+	id, token := postShare(t, testSnippet("legacy"))
+	if id != legacyID {
+		t.Fatalf("got ID %q, expected the legacy share %q", id, legacyID)
+	}
+	if w := shareRequest(t, "DELETE", "/api/share/"+id, token, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d (%s)", w.Code, w.Body)
+	}
+	if _, err := store.Get(ctx, id); err != nil {
+		t.Errorf("legacy share was deleted: %v", err)
+	}
+}
+
+func TestShareUpdate(t *testing.T) {
+	ctx := context.Background()
+	store := useMemoryShares(t)
+	useShareConfig(t)
+
+	update := func(id, token, body, query string) string {
+		t.Helper()
+		w := shareRequest(t, "PUT", "/api/share/"+id+query, token, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: status %d (%s)", id, w.Code, w.Body)
+		}
+		var response struct{ ID string }
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.ID
+	}
+	code := func(id string) any {
+		t.Helper()
+		s, err := store.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("share %s: %v", id, err)
+		}
+		return s.Data.(map[string]any)["code"]
+	}
+
+	// The only owner changes the share in place.
+	id, token := postShare(t, testSnippet("a"))
+	if newID := update(id, token, testSnippet("b"), "?ttl=1d"); newID != id {
+		t.Errorf("update by the only owner: got ID %q, expected %q", newID, id)
+	}
+	if s, _ := store.Get(ctx, id); code(id) != "b" || s.Expires == nil {
+		t.Errorf("updated share: %+v", s)
+	}
+	if w := shareRequest(t, "PUT", "/api/share/"+id+"?ttl=week", token, testSnippet("c")); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid TTL: status %d, expected %d", w.Code, http.StatusBadRequest)
+	}
+	if w := shareRequest(t, "PUT", "/api/share/"+id, token, `{"code": ""}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid share: status %d, expected %d", w.Code, http.StatusUnprocessableEntity)
+	}
+
+	// If others shared the same snippet, the update gets a new ID and the
+	// others keep their snippet.
+	shared, token1 := postShare(t, testSnippet("shared"))
+	_, token2 := postShare(t, testSnippet("shared"))
+	newID := update(shared, token1, testSnippet("mine"), "")
+	if newID == shared {
+		t.Fatalf("update of a share with several owners kept ID %q", shared)
+	}
+	if code(shared) != "shared" || code(newID) != "mine" {
+		t.Errorf("after update: %q is %v, %q is %v", shared, code(shared), newID, code(newID))
+	}
+	if w := shareRequest(t, "DELETE", "/api/share/"+shared, token1, ""); w.Code != http.StatusForbidden {
+		t.Errorf("old share still owned by the updater: status %d", w.Code)
+	}
+	if w := shareRequest(t, "DELETE", "/api/share/"+newID, token2, ""); w.Code != http.StatusForbidden {
+		t.Errorf("new share owned by the other owner: status %d", w.Code)
+	}
+	if w := shareRequest(t, "DELETE", "/api/share/"+newID, token1, ""); w.Code != http.StatusNoContent {
+		t.Errorf("new share not owned by the updater: status %d", w.Code)
+	}
+}
+
+func TestParseShareTTL(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	for _, tc := range []struct {
+		value   string
+		expires string // empty to keep the share forever
+		err     bool
+	}{
+		{"", "", false},
+		{"forever", "", false},
+		{"30d", "2024-07-01T10:00:00Z", false},
+		{"1d", "2024-06-02T10:00:00Z", false},
+		{"12h", "2024-06-01T22:00:00Z", false},
+		{"90m", "2024-06-01T11:30:00Z", false},
+		{"0d", "", true},
+		{"-1d", "", true},
+		{"-5m", "", true},
+		{"0s", "", true},
+		{"d", "", true},
+		{"1.5d", "", true},
+		{"week", "", true},
+		{"Forever", "", true},
+	} {
+		expires, err := parseShareTTL(tc.value, now)
+		if tc.err {
+			if err == nil {
+				t.Errorf("TTL %q: expected an error, got %v", tc.value, expires)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("TTL %q: %v", tc.value, err)
+			continue
+		}
+		got := ""
+		if expires != nil {
+			got = expires.Format(time.RFC3339)
+		}
+		if got != tc.expires {
+			t.Errorf("TTL %q: expires at %q, expected %q", tc.value, got, tc.expires)
+		}
+	}
+}
+
+func TestSweepExpiredShares(t *testing.T) {
+	ctx := context.Background()
+	store := useMemoryShares(t)
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	for _, sh := range []*share{
+		{ID: "expired", Time: now, Data: "a", Expires: &past},
+		{ID: "later", Time: now, Data: "b", Expires: &future},
+		{ID: "forever", Time: now, Data: "c"},
+	} {
+		if err := store.Create(ctx, sh); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Expired shares are hidden before the sweeper removed them.
+	if _, err := getShare(ctx, "expired"); err != errShareNotFound {
+		t.Errorf("expired share: got error %v, expected %v", err, errShareNotFound)
+	}
+
+	sweepCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		sweepExpiredShares(sweepCtx, time.Hour)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := store.Get(ctx, "expired"); err == errShareNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired share was not removed by the first sweep")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	for _, id := range []string{"later", "forever"} {
+		if _, err := getShare(ctx, id); err != nil {
+			t.Errorf("share %s: %v", id, err)
+		}
+	}
+}
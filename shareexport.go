@@ -0,0 +1,218 @@
+package main
+
+// This file implements exporting a share as a Go module that can be built and
+// flashed locally, as a zip file or a txtar archive.
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// exportFile is a single file in an exported share.
+type exportFile struct {
+	Name string
+	Data []byte
+}
+
+// handleShareExport handles GET /api/share/{id}/export. The format query
+// parameter selects the archive format: "zip" (the default) or "txtar".
+func handleShareExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		format = "zip"
+	case "zip", "txtar":
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("unrecognized format"))
+		return
+	}
+
+	id := r.PathValue("id")
+	s, err := getShare(r.Context(), id)
+	if err == errShareNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("ID not found"))
+		return
+	}
+	if err != nil {
+		metricShareErrors.Inc("read")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not fetch shared data"))
+		logger(r.Context()).Error("could not fetch shared data", "id", id, "err", err)
+		return
+	}
+
+	files, err := exportShare(s)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("could not export share: " + err.Error()))
+		return
+	}
+	metricShareReads.Inc()
+
+	name := "playground-" + s.ID
+	var data []byte
+	switch format {
+	case "zip":
+		data, err = exportZip(name, files, s.Time)
+		w.Header().Set("Content-Type", "application/zip")
+	case "txtar":
+		data = exportTxtar(name, files)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not create archive"))
+		logger(r.Context()).Error("could not create archive", "id", id, "err", err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+	w.Write(data)
+}
+
+// exportShare returns the files of the Go module for the given share.
+func exportShare(s *share) ([]exportFile, error) {
+	// Decode the state leniently: shares stored before validation was added
+	// might contain extra fields.
+	raw, err := json.Marshal(s.Data)
+	if err != nil {
+		return nil, err
+	}
+	var state shareState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("invalid state: %w", err)
+	}
+
+	// Find the board, which is the "main" part.
+	var location string
+	for _, part := range state.Parts {
+		if part.ID == "main" {
+			location = part.Location
+		}
+	}
+	if !validPartLocation.MatchString(location) {
+		return nil, fmt.Errorf("share has no board")
+	}
+	lib, err := getPartsLibrary()
+	if err != nil {
+		return nil, err
+	}
+	board, err := readPartDefinition(lib.fsys, location)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unknown board %q", location)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", location, err)
+	}
+
+	code := state.Code
+	if code != "" && !strings.HasSuffix(code, "\n") {
+		code += "\n"
+	}
+	files := []exportFile{
+		{"main.go", []byte(code)},
+	}
+	for _, fn := range []string{"go.mod", "go.sum"} {
+		data, err := fs.ReadFile(templateFS(), fn)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, exportFile{fn, data})
+	}
+	wiring, err := json.MarshalIndent(map[string]any{
+		"parts": state.Parts,
+		"wires": state.Wires,
+	}, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, exportFile{"wiring.json", append(wiring, '\n')})
+	files = append(files, exportFile{"README.md", exportReadme(s, &state, board)})
+	return files, nil
+}
+
+// exportReadme returns the README of an exported share, with instructions to
+// build and run the code for the share's board.
+func exportReadme(s *share, state *shareState, board *partDefinition) []byte {
+	title := state.HumanName
+	if title == "" {
+		title = board.HumanName
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# %s\n\n", title)
+	fmt.Fprintf(buf, "Exported from the TinyGo Playground, share %s.\n\n", s.ID)
+	// Firmware is built in the format to flash, or else the default or first
+	// format the board supports that TinyGo can write directly.
+	var format string
+	for _, f := range append([]string{board.FirmwareFormat, board.defaultFormat()}, board.supportedFirmwareFormats()...) {
+		if f != "bundle" && slices.Contains(board.supportedFirmwareFormats(), f) {
+			format = f
+			break
+		}
+	}
+	switch {
+	case state.Compiler == "go":
+		fmt.Fprintf(buf, "Run the program using Go:\n\n    go run .\n")
+	case !board.isBoard() || format == "":
+		// The console, which runs on the host.
+		fmt.Fprintf(buf, "Run the program using TinyGo:\n\n    tinygo run .\n")
+	default:
+		fmt.Fprintf(buf, "Connect the %s and flash the program using TinyGo:\n\n", board.HumanName)
+		fmt.Fprintf(buf, "    tinygo flash -target=%s .\n\n", board.buildTarget())
+		fmt.Fprintf(buf, "Or build a firmware file to copy to the board:\n\n")
+		fmt.Fprintf(buf, "    tinygo build -target=%s -o firmware.%s .\n", board.buildTarget(), format)
+	}
+	if len(state.Parts) > 1 {
+		fmt.Fprintf(buf, "\nThe parts and wires of the schematic are listed in wiring.json.\n")
+	}
+	return buf.Bytes()
+}
+
+// exportZip returns a zip file with all files in a directory with the given
+// name.
+func exportZip(dir string, files []exportFile, modified time.Time) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, file := range files {
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     dir + "/" + file.Name,
+			Method:   zip.Deflate,
+			Modified: modified,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(file.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exportTxtar returns a txtar archive (see golang.org/x/tools/txtar) with all
+// files in a directory with the given name.
+func exportTxtar(dir string, files []exportFile) []byte {
+	buf := &bytes.Buffer{}
+	for _, file := range files {
+		fmt.Fprintf(buf, "-- %s/%s --\n", dir, file.Name)
+		buf.Write(file.Data)
+		if len(file.Data) != 0 && file.Data[len(file.Data)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
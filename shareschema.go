@@ -0,0 +1,280 @@
+package main
+
+// This file defines the simulator state that is stored in a share, and
+// validates it against the parts library so that only schematics the
+// frontend can load are stored.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// shareState is the simulator state as sent by the frontend when sharing a
+// snippet. It mirrors the project objects in dashboard.js.
+type shareState struct {
+	Name             string      `json:"name,omitempty"`
+	HumanName        string      `json:"humanName,omitempty"`
+	DefaultHumanName string      `json:"defaultHumanName,omitempty"`
+	Created          string      `json:"created,omitempty"` // when the project was first saved in the browser
+	Code             string      `json:"code"`
+	Compiler         string      `json:"compiler,omitempty"`
+	Parts            []sharePart `json:"parts"`
+	Wires            []shareWire `json:"wires"`
+}
+
+// sharePart is a single part in the schematic. It is either a board or part
+// loaded from a JSON file in the parts library (Location), or a simple part
+// from parts.json configured inline (Config).
+type sharePart struct {
+	ID       string           `json:"id"`
+	Location string           `json:"location,omitempty"`
+	Config   *sharePartConfig `json:"config,omitempty"`
+	X        float64          `json:"x"`
+	Y        float64          `json:"y"`
+	Rotation float64          `json:"rotation,omitempty"`
+}
+
+// sharePartConfig is the inline configuration of a part from parts.json, with
+// the options selected in the "Add" panel.
+type sharePartConfig struct {
+	Type      string `json:"type"`
+	HumanName string `json:"humanName,omitempty"`
+	SVG       string `json:"svg"`
+	Length    int    `json:"length,omitempty"` // number of LEDs in a WS2812 strip
+	Color     []int  `json:"color,omitempty"`  // RGB color of a LED
+}
+
+// shareWire is a wire drawn in the schematic between two pins. Pins are
+// named like "main.D13": the part ID and the pin name separated by a dot.
+type shareWire struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Part IDs are generated by the frontend (or "main" for the board), and must
+// not contain a dot because that separates the part ID from the pin name.
+var validPartID = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// Locations of parts that can be referenced from a share.
+var validPartLocation = regexp.MustCompile(`^parts/[a-z0-9_-]+\.json$`)
+
+// Pins in a part SVG, as detected by the frontend.
+var svgPinAttr = regexp.MustCompile(`data-pin="([^"]*)"`)
+
+// partsLibrary contains the parts that can be used in a schematic.
+type partsLibrary struct {
+	fsys fs.FS
+
+	// Part types and SVGs of the inline parts in parts.json.
+	types map[string]bool
+	svgs  map[string]bool
+
+	lock   sync.Mutex
+	pins   map[string]map[string]bool // pins by SVG path
+	boards map[string]*partDefinition // by name, see board
+}
+
+var (
+	loadPartsOnce sync.Once
+	loadedParts   *partsLibrary
+	loadPartsErr  error
+)
+
+// getPartsLibrary returns the parts library of the frontend that is served,
+// loading it the first time it is called.
+func getPartsLibrary() (*partsLibrary, error) {
+	loadPartsOnce.Do(func() {
+		loadedParts, loadPartsErr = loadPartsLibrary(frontendFS())
+	})
+	return loadedParts, loadPartsErr
+}
+
+// loadPartsLibrary reads parts/parts.json from the given frontend directory.
+func loadPartsLibrary(fsys fs.FS) (*partsLibrary, error) {
+	data, err := fs.ReadFile(fsys, "parts/parts.json")
+	if err != nil {
+		return nil, err
+	}
+	var listing partsIndex
+	if err := json.Unmarshal(data, &listing); err != nil {
+		return nil, fmt.Errorf("parts/parts.json: %w", err)
+	}
+	lib := &partsLibrary{
+		fsys:   fsys,
+		types:  make(map[string]bool),
+		svgs:   make(map[string]bool),
+		pins:   make(map[string]map[string]bool),
+		boards: make(map[string]*partDefinition),
+	}
+	for _, part := range listing.Parts {
+		if part.Location != "" {
+			continue // referenced by location, not inline
+		}
+		lib.types[part.Config.Type] = true
+		lib.svgs[part.Config.SVG] = true
+	}
+	return lib, nil
+}
+
+// svgPins returns the names of the pins in the SVG at the given path.
+func (lib *partsLibrary) svgPins(svgPath string) (map[string]bool, error) {
+	lib.lock.Lock()
+	defer lib.lock.Unlock()
+	if pins, ok := lib.pins[svgPath]; ok {
+		return pins, nil
+	}
+	data, err := fs.ReadFile(lib.fsys, svgPath)
+	if err != nil {
+		return nil, err
+	}
+	pins := make(map[string]bool)
+	for _, match := range svgPinAttr.FindAllSubmatch(data, -1) {
+		name := string(match[1])
+		if strings.Contains(name, ".") {
+			continue // ignored by the frontend
+		}
+		pins[name] = true
+	}
+	lib.pins[svgPath] = pins
+	return pins, nil
+}
+
+// locationPins returns the pins of the part (usually a board) defined in the
+// JSON file at the given location.
+func (lib *partsLibrary) locationPins(location string) (map[string]bool, error) {
+	data, err := fs.ReadFile(lib.fsys, location)
+	if err != nil {
+		return nil, err
+	}
+	var part struct {
+		SVG string `json:"svg"`
+	}
+	if err := json.Unmarshal(data, &part); err != nil {
+		return nil, err
+	}
+	if part.SVG == "" {
+		return nil, nil // no pins, like the console
+	}
+	// The SVG path is relative to the JSON file.
+	svgPath := path.Join(path.Dir(location), part.SVG)
+	if !fs.ValidPath(svgPath) {
+		return nil, fmt.Errorf("invalid SVG path %q", part.SVG)
+	}
+	return lib.svgPins(svgPath)
+}
+
+// parseShareState decodes and validates the shared simulator state. It
+// returns all problems found in the state, or a nil slice if the state is
+// valid.
+func parseShareState(data []byte, lib *partsLibrary) (*shareState, []string) {
+	var state shareState
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&state); err != nil {
+		return nil, []string{fmt.Sprintf("invalid state: %v", err)}
+	}
+	if decoder.More() {
+		return nil, []string{"invalid state: trailing data"}
+	}
+
+	var problems []string
+	problemf := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch state.Compiler {
+	case "", "go", "tinygo":
+	default:
+		problemf("unknown compiler %q", state.Compiler)
+	}
+
+	if len(state.Parts) == 0 {
+		problemf("no parts")
+	}
+	partPins := make(map[string]map[string]bool)
+	for i, part := range state.Parts {
+		if !validPartID.MatchString(part.ID) {
+			problemf("parts[%d]: invalid ID %q", i, part.ID)
+			continue
+		}
+		if _, ok := partPins[part.ID]; ok {
+			problemf("parts[%d]: duplicate ID %q", i, part.ID)
+			continue
+		}
+		var pins map[string]bool
+		var err error
+		switch {
+		case part.Location != "" && part.Config != nil:
+			problemf("parts[%d]: both location and config set", i)
+			continue
+		case part.Location != "":
+			if !validPartLocation.MatchString(part.Location) || part.Location == "parts/parts.json" {
+				problemf("parts[%d]: invalid location %q", i, part.Location)
+				continue
+			}
+			pins, err = lib.locationPins(part.Location)
+			if errors.Is(err, fs.ErrNotExist) {
+				problemf("parts[%d]: unknown location %q", i, part.Location)
+				continue
+			} else if err != nil {
+				problemf("parts[%d]: could not load %q: %v", i, part.Location, err)
+				continue
+			}
+		case part.Config != nil:
+			if !lib.types[part.Config.Type] {
+				problemf("parts[%d]: unknown part type %q", i, part.Config.Type)
+				continue
+			}
+			if !lib.svgs[part.Config.SVG] {
+				problemf("parts[%d]: unknown SVG %q", i, part.Config.SVG)
+				continue
+			}
+			if part.Config.Length < 0 || part.Config.Length > 1000 {
+				problemf("parts[%d]: invalid length %d", i, part.Config.Length)
+			}
+			if part.Config.Color != nil && len(part.Config.Color) != 3 {
+				problemf("parts[%d]: invalid color", i)
+			}
+			pins, err = lib.svgPins(part.Config.SVG)
+			if err != nil {
+				problemf("parts[%d]: could not load %q: %v", i, part.Config.SVG, err)
+				continue
+			}
+		default:
+			problemf("parts[%d]: no location or config", i)
+			continue
+		}
+		partPins[part.ID] = pins
+	}
+
+	for i, wire := range state.Wires {
+		for _, pin := range []struct{ field, id string }{{"from", wire.From}, {"to", wire.To}} {
+			pos := strings.LastIndexByte(pin.id, '.')
+			if pos < 0 {
+				problemf("wires[%d].%s: invalid pin %q", i, pin.field, pin.id)
+				continue
+			}
+			partID, pinName := pin.id[:pos], pin.id[pos+1:]
+			pins, ok := partPins[partID]
+			if !ok {
+				problemf("wires[%d].%s: unknown part %q", i, pin.field, partID)
+				continue
+			}
+			if !pins[pinName] {
+				problemf("wires[%d].%s: part %q has no pin %q", i, pin.field, partID, pinName)
+			}
+		}
+	}
+
+	if problems != nil {
+		return nil, problems
+	}
+	return &state, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestParseShareState(t *testing.T) {
+	lib, err := loadPartsLibrary(os.DirFS("."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const board = `{"id": "main", "location": "parts/arduino.json", "x": 0, "y": 0}`
+	const led = `{"id": "led1", "config": {"type": "led", "humanName": "LED", "svg": "parts/led-tht-5mm.svg", "color": [255, 0, 0]}, "x": 10, "y": 20, "rotation": 90}`
+	for _, tc := range []struct {
+		name     string
+		state    string
+		problems []string
+	}{
+		{"board only", `{"code": "package main", "parts": [` + board + `], "wires": []}`, nil},
+		{"console", `{"code": "package main", "compiler": "go", "parts": [{"id": "main", "location": "parts/console.json", "x": 0, "y": 0}], "wires": []}`, nil},
+		{"schematic", `{"name": "arduino", "humanName": "Blink", "code": "package main", "compiler": "tinygo", "parts": [` + board + `, ` + led + `], "wires": [{"from": "main.D13", "to": "led1.anode"}, {"from": "led1.cathode", "to": "main.GND#1"}]}`, nil},
+
+		{"not an object", `[]`, []string{"invalid state: json: cannot unmarshal array into Go value of type main.shareState"}},
+		{"unknown field", `{"code": "", "parts": [], "wires": [], "script": "x"}`, []string{`invalid state: json: unknown field "script"`}},
+		{"trailing data", `{"code": "", "parts": [` + board + `], "wires": []} {}`, []string{"invalid state: trailing data"}},
+		{"no parts", `{"code": "", "compiler": "gcc", "parts": [], "wires": []}`, []string{`unknown compiler "gcc"`, "no parts"}},
+		{"invalid parts", `{"code": "", "parts": [
+			{"id": "main.1", "location": "parts/arduino.json", "x": 0, "y": 0},
+			` + board + `,
+			` + board + `,
+			{"id": "a", "location": "parts/../main.go", "x": 0, "y": 0},
+			{"id": "b", "location": "parts/parts.json", "x": 0, "y": 0},
+			{"id": "c", "location": "parts/nonexistent.json", "x": 0, "y": 0},
+			{"id": "d", "location": "parts/led.json", "config": {"type": "led", "svg": "parts/led-tht-5mm.svg"}, "x": 0, "y": 0},
+			{"id": "e", "x": 0, "y": 0},
+			{"id": "f", "config": {"type": "script", "svg": "parts/led-tht-5mm.svg"}, "x": 0, "y": 0},
+			{"id": "g", "config": {"type": "led", "svg": "parts/arduino.svg"}, "x": 0, "y": 0},
+			{"id": "h", "config": {"type": "ws2812", "svg": "parts/ws2812.svg", "length": 1001, "color": [1, 2]}, "x": 0, "y": 0}
+		], "wires": []}`, []string{
+			`parts[0]: invalid ID "main.1"`,
+			`parts[2]: duplicate ID "main"`,
+			`parts[3]: invalid location "parts/../main.go"`,
+			`parts[4]: invalid location "parts/parts.json"`,
+			`parts[5]: unknown location "parts/nonexistent.json"`,
+			"parts[6]: both location and config set",
+			"parts[7]: no location or config",
+			`parts[8]: unknown part type "script"`,
+			`parts[9]: unknown SVG "parts/arduino.svg"`,
+			"parts[10]: invalid length 1001",
+			"parts[10]: invalid color",
+		}},
+		{"invalid wires", `{"code": "", "parts": [` + board + `, ` + led + `], "wires": [
+			{"from": "main.D13", "to": "led1.anode"},
+			{"from": "mainD13", "to": "led2.anode"},
+			{"from": "main.X99", "to": "led1.gate"}
+		]}`, []string{
+			`wires[1].from: invalid pin "mainD13"`,
+			`wires[1].to: unknown part "led2"`,
+			`wires[2].from: part "main" has no pin "X99"`,
+			`wires[2].to: part "led1" has no pin "gate"`,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			state, problems := parseShareState([]byte(tc.state), lib)
+			if !slices.Equal(problems, tc.problems) {
+				t.Errorf("got problems:\n%q\nexpected:\n%q", problems, tc.problems)
+			}
+			if (state == nil) != (tc.problems != nil) {
+				t.Errorf("got state %v with problems %q", state, problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+// This file implements the share stores that don't depend on Google Cloud:
+// in memory, as files in a directory, and in an embedded BoltDB database.
+// They make it possible to self-host the playground.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// IDs that can be safely used as a file name or database key.
+var validShareID = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// memoryShareStore keeps shares in memory. They are lost when the server
+// restarts, so it is only useful for development and testing.
+type memoryShareStore struct {
+	lock   sync.RWMutex
+	shares map[string][]byte
+}
+
+func newMemoryShareStore() *memoryShareStore {
+	return &memoryShareStore{
+		shares: make(map[string][]byte),
+	}
+}
+
+func (s *memoryShareStore) Get(ctx context.Context, id string) (*share, error) {
+	s.lock.RLock()
+	data, ok := s.shares[id]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, errShareNotFound
+	}
+	return decodeShare(data)
+}
+
+func (s *memoryShareStore) Create(ctx context.Context, sh *share) error {
+	data, err := json.Marshal(sh)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.shares[sh.ID]; ok {
+		return errShareExists
+	}
+	s.shares[sh.ID] = data
+	return nil
+}
+
+func (s *memoryShareStore) List(ctx context.Context, fn func(*share) error) error {
+	s.lock.RLock()
+	ids := make([]string, 0, len(s.shares))
+	for id := range s.shares {
+		ids = append(ids, id)
+	}
+	s.lock.RUnlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		sh, err := s.Get(ctx, id)
+		if err == errShareNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(sh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryShareStore) Update(ctx context.Context, sh *share) error {
+	data, err := json.Marshal(sh)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.shares[sh.ID]; !ok {
+		return errShareNotFound
+	}
+	s.shares[sh.ID] = data
+	return nil
+}
+
+func (s *memoryShareStore) Delete(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.shares[id]; !ok {
+		return errShareNotFound
+	}
+	delete(s.shares, id)
+	return nil
+}
+
+func (s *memoryShareStore) Modify(ctx context.Context, id string, fn func(*share) (*share, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, ok := s.shares[id]
+	if !ok {
+		return errShareNotFound
+	}
+	sh, err := decodeShare(data)
+	if err != nil {
+		return err
+	}
+	sh, err = fn(sh)
+	if err != nil {
+		return err
+	}
+	if sh == nil {
+		delete(s.shares, id)
+		return nil
+	}
+	data, err = json.Marshal(sh)
+	if err != nil {
+		return err
+	}
+	s.shares[id] = data
+	return nil
+}
+
+func (s *memoryShareStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	return deleteExpiredShares(ctx, s, now)
+}
+
+func (s *memoryShareStore) StripIPs(ctx context.Context, before time.Time) (int, error) {
+	return stripShareIPs(ctx, s, before)
+}
+
+func (s *memoryShareStore) Forks(ctx context.Context, parent string) ([]*share, error) {
+	return listForks(ctx, s, parent)
+}
+
+func (s *memoryShareStore) Close() error {
+	return nil
+}
+
+// fileShareStore stores every share as a JSON file in a directory. Only one
+// server can use the directory at a time, as Modify relies on a lock in
+// memory.
+type fileShareStore struct {
+	dir string
+
+	// Held while modifying or removing an existing share, so that Modify
+	// doesn't overwrite changes made while fn runs.
+	lock sync.Mutex
+}
+
+func newFileShareStore(dir string) (*fileShareStore, error) {
+	if dir == "" {
+		return nil, errors.New("no share path configured for the file share store")
+	}
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, err
+	}
+	return &fileShareStore{dir: dir}, nil
+}
+
+func (s *fileShareStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *fileShareStore) Get(ctx context.Context, id string) (*share, error) {
+	if !validShareID.MatchString(id) {
+		return nil, errShareNotFound
+	}
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errShareNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeShare(data)
+}
+
+func (s *fileShareStore) Create(ctx context.Context, sh *share) error {
+	if !validShareID.MatchString(sh.ID) {
+		return fmt.Errorf("invalid share ID: %q", sh.ID)
+	}
+	// Write to a temporary file first and then link it into place, so that
+	// readers never see a partially written file and an existing share is
+	// never overwritten.
+	tmp, err := s.writeTemp(sh)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	err = os.Link(tmp, s.path(sh.ID))
+	if errors.Is(err, os.ErrExist) {
+		return errShareExists
+	}
+	return err
+}
+
+func (s *fileShareStore) Update(ctx context.Context, sh *share) error {
+	if !validShareID.MatchString(sh.ID) {
+		return errShareNotFound
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.replace(sh)
+}
+
+// replace replaces an existing share. The lock must be held.
+func (s *fileShareStore) replace(sh *share) error {
+	if _, err := os.Stat(s.path(sh.ID)); errors.Is(err, os.ErrNotExist) {
+		return errShareNotFound
+	}
+	tmp, err := s.writeTemp(sh)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path(sh.ID)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes the share to a new temporary file in the store directory,
+// and returns its path.
+func (s *fileShareStore) writeTemp(sh *share) (string, error) {
+	data, err := json.Marshal(sh)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func (s *fileShareStore) Delete(ctx context.Context, id string) error {
+	if !validShareID.MatchString(id) {
+		return errShareNotFound
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.remove(id)
+}
+
+// remove removes an existing share. The lock must be held.
+func (s *fileShareStore) remove(id string) error {
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return errShareNotFound
+	}
+	return err
+}
+
+func (s *fileShareStore) Modify(ctx context.Context, id string, fn func(*share) (*share, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sh, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	sh, err = fn(sh)
+	if err != nil {
+		return err
+	}
+	if sh == nil {
+		return s.remove(id)
+	}
+	return s.replace(sh)
+}
+
+func (s *fileShareStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	return deleteExpiredShares(ctx, s, now)
+}
+
+func (s *fileShareStore) StripIPs(ctx context.Context, before time.Time) (int, error) {
+	return stripShareIPs(ctx, s, before)
+}
+
+func (s *fileShareStore) List(ctx context.Context, fn func(*share) error) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validShareID.MatchString(id) {
+			continue
+		}
+		sh, err := s.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := fn(sh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileShareStore) Forks(ctx context.Context, parent string) ([]*share, error) {
+	return listForks(ctx, s, parent)
+}
+
+func (s *fileShareStore) Close() error {
+	return nil
+}
+
+// boltShareStore stores shares in a BoltDB database file.
+type boltShareStore struct {
+	db *bolt.DB
+}
+
+// Name of the bucket in the database that contains all shares.
+var boltShareBucket = []byte("shared")
+
+func newBoltShareStore(path string) (*boltShareStore, error) {
+	if path == "" {
+		return nil, errors.New("no share path configured for the bolt share store")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltShareBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltShareStore{db: db}, nil
+}
+
+func (s *boltShareStore) Get(ctx context.Context, id string) (*share, error) {
+	var data []byte
+	s.db.View(func(tx *bolt.Tx) error {
+		// The returned value is only valid inside the transaction.
+		data = append(data, tx.Bucket(boltShareBucket).Get([]byte(id))...)
+		return nil
+	})
+	if data == nil {
+		return nil, errShareNotFound
+	}
+	return decodeShare(data)
+}
+
+func (s *boltShareStore) Create(ctx context.Context, sh *share) error {
+	data, err := json.Marshal(sh)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltShareBucket)
+		if b.Get([]byte(sh.ID)) != nil {
+			return errShareExists
+		}
+		return b.Put([]byte(sh.ID), data)
+	})
+}
+
+func (s *boltShareStore) List(ctx context.Context, fn func(*share) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltShareBucket).ForEach(func(k, v []byte) error {
+			sh, err := decodeShare(v)
+			if err != nil {
+				return err
+			}
+			return fn(sh)
+		})
+	})
+}
+
+func (s *boltShareStore) Update(ctx context.Context, sh *share) error {
+	data, err := json.Marshal(sh)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltShareBucket)
+		if b.Get([]byte(sh.ID)) == nil {
+			return errShareNotFound
+		}
+		return b.Put([]byte(sh.ID), data)
+	})
+}
+
+func (s *boltShareStore) Delete(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltShareBucket)
+		if b.Get([]byte(id)) == nil {
+			return errShareNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+func (s *boltShareStore) Modify(ctx context.Context, id string, fn func(*share) (*share, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltShareBucket)
+		data := b.Get([]byte(id))
+		if data == nil {
+			return errShareNotFound
+		}
+		sh, err := decodeShare(data)
+		if err != nil {
+			return err
+		}
+		sh, err = fn(sh)
+		if err != nil {
+			return err
+		}
+		if sh == nil {
+			return b.Delete([]byte(id))
+		}
+		data, err = json.Marshal(sh)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+}
+
+func (s *boltShareStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltShareBucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			sh, err := decodeShare(v)
+			if err != nil {
+				return err
+			}
+			if sh.expired(now) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Delete after iterating, because deleting while iterating with a
+		// cursor skips keys.
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *boltShareStore) StripIPs(ctx context.Context, before time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltShareBucket)
+		var stripped []*share
+		err := b.ForEach(func(k, v []byte) error {
+			sh, err := decodeShare(v)
+			if err != nil {
+				return err
+			}
+			if sh.IP != "" && sh.Time.Before(before) {
+				sh.IP = ""
+				stripped = append(stripped, sh)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Write after iterating, because modifying while iterating with a
+		// cursor is not allowed.
+		for _, sh := range stripped {
+			data, err := json.Marshal(sh)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(sh.ID), data); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *boltShareStore) Forks(ctx context.Context, parent string) ([]*share, error) {
+	return listForks(ctx, s, parent)
+}
+
+func (s *boltShareStore) Close() error {
+	return s.db.Close()
+}
+
+// decodeShare decodes a share as stored by the memory, file and bolt stores.
+func decodeShare(data []byte) (*share, error) {
+	sh := &share{}
+	if err := json.Unmarshal(data, sh); err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testShareStores returns an empty store of every type that doesn't need
+// Google Cloud.
+func testShareStores(t *testing.T) map[string]shareStore {
+	t.Helper()
+	stores := map[string]shareStore{"memory": newMemoryShareStore()}
+	dir := t.TempDir()
+	for storage, path := range map[string]string{
+		"file": filepath.Join(dir, "shares"),
+		"bolt": filepath.Join(dir, "shares.db"),
+	} {
+		store, err := openShareStore(storage, path)
+		if err != nil {
+			t.Fatalf("could not open %s store: %v", storage, err)
+		}
+		t.Cleanup(func() { store.Close() })
+		stores[storage] = store
+	}
+	return stores
+}
+
+func TestShareStoreStripIPs(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for name, store := range testShareStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, sh := range []*share{
+				{ID: "old", Time: now.AddDate(0, 0, -40), IP: "192.0.2.0/24", Data: "a"},
+				{ID: "oldNoIP", Time: now.AddDate(0, 0, -40), Data: "b"},
+				{ID: "recent", Time: now.AddDate(0, 0, -1), IP: "198.51.100.0/24", Data: "c"},
+			} {
+				if err := store.Create(ctx, sh); err != nil {
+					t.Fatal(err)
+				}
+			}
+			n, err := store.StripIPs(ctx, now.AddDate(0, 0, -30))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("stripped %d shares, expected 1", n)
+			}
+			for id, want := range map[string]string{"old": "", "oldNoIP": "", "recent": "198.51.100.0/24"} {
+				sh, err := store.Get(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sh.IP != want {
+					t.Errorf("share %s has IP %q, expected %q", id, sh.IP, want)
+				}
+				if sh.Data != map[string]string{"old": "a", "oldNoIP": "b", "recent": "c"}[id] {
+					t.Errorf("share %s lost its data: %v", id, sh.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestShareStoreDeleteExpired(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	past, exact, future := now.Add(-time.Hour), now, now.Add(time.Hour)
+	for name, store := range testShareStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, sh := range []*share{
+				{ID: "past", Time: now.AddDate(0, 0, -1), Data: "a", Expires: &past},
+				{ID: "exact", Time: now.AddDate(0, 0, -1), Data: "b", Expires: &exact},
+				{ID: "future", Time: now.AddDate(0, 0, -1), Data: "c", Expires: &future},
+				{ID: "forever", Time: now.AddDate(0, 0, -1), Data: "d"},
+			} {
+				if err := store.Create(ctx, sh); err != nil {
+					t.Fatal(err)
+				}
+			}
+			n, err := store.DeleteExpired(ctx, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Errorf("deleted %d shares, expected 2", n)
+			}
+			for id, exists := range map[string]bool{"past": false, "exact": false, "future": true, "forever": true} {
+				sh, err := store.Get(ctx, id)
+				if exists && err != nil {
+					t.Errorf("share %s: %v", id, err)
+				} else if !exists && err != errShareNotFound {
+					t.Errorf("share %s: got %v, %v, expected it to be deleted", id, sh, err)
+				}
+			}
+			if n, err := store.DeleteExpired(ctx, now); n != 0 || err != nil {
+				t.Errorf("second sweep deleted %d shares (error %v)", n, err)
+			}
+		})
+	}
+}
+
+func TestShareStoreModify(t *testing.T) {
+	ctx := context.Background()
+	errStop := errors.New("stop")
+	for name, store := range testShareStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Create(ctx, &share{ID: "a", Data: "a", OwnerHashes: []string{"x"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Changes are stored.
+			err := store.Modify(ctx, "a", func(s *share) (*share, error) {
+				s.addOwner("y")
+				return s, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sh, err := store.Get(ctx, "a"); err != nil || !slices.Equal(sh.OwnerHashes, []string{"x", "y"}) {
+				t.Errorf("after adding an owner: %+v, %v", sh, err)
+			}
+
+			// An error leaves the share unchanged.
+			err = store.Modify(ctx, "a", func(s *share) (*share, error) {
+				s.Data = "changed"
+				return nil, errStop
+			})
+			if err != errStop {
+				t.Errorf("got error %v, expected %v", err, errStop)
+			}
+			if sh, err := store.Get(ctx, "a"); err != nil || sh.Data != "a" {
+				t.Errorf("after an error: %+v, %v", sh, err)
+			}
+
+			// Returning nil deletes the share.
+			err = store.Modify(ctx, "a", func(s *share) (*share, error) {
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Get(ctx, "a"); err != errShareNotFound {
+				t.Errorf("deleted share: got error %v, expected %v", err, errShareNotFound)
+			}
+			err = store.Modify(ctx, "a", func(s *share) (*share, error) {
+				t.Error("fn called for a missing share")
+				return s, nil
+			})
+			if err != errShareNotFound {
+				t.Errorf("missing share: got error %v, expected %v", err, errShareNotFound)
+			}
+		})
+	}
+}
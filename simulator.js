@@ -30,6 +30,10 @@ class Simulator {
     this.runnerURL = config.runnerURL || new URL('./worker/runner.js', this.baseURL);
     this.saveState = config.saveState || (() => {});
 
+    // ID of the share the current code was loaded from (or last shared as),
+    // which is the parent of the next share.
+    this.shareID = config.shareID || shareIDFromLocation();
+
     // Initialize member variables.
     this.worker = null;
     this.workerUpdate = null;
@@ -525,21 +529,30 @@ class Simulator {
   }
 
   // Share the code in the editor. Returns the share ID, which can be used as
-  // part of a URL.
+  // part of a URL. If the code was loaded from a share (or shared before), the
+  // new share is linked to that one as a fork.
   async share() {
     // Get the current state.
     this.schematic.state.code = this.editor.text();
     this.saveState();
 
     // Save this snippet.
-    let response = await fetch(`${this.apiURL}/share`, {
+    let url = `${this.apiURL}/share`;
+    if (this.shareID) {
+      url += '?parent=' + encodeURIComponent(this.shareID);
+    }
+    let response = await fetch(url, {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
       },
       body: JSON.stringify(this.schematic.state),
     });
+    if (!response.ok) {
+      throw new Error(`could not share: ${await response.text()}`);
+    }
     let data = await response.json();
+    this.shareID = data.id;
 
     // The caller can decide what to do with this, like updating the current URL
     // or open tinygo.org/play/s/<id>
@@ -547,6 +560,15 @@ class Simulator {
   }
 }
 
+// Return the share ID in the URL of the current page, like /play/s/<id>, or
+// null if it isn't a share URL.
+function shareIDFromLocation() {
+  if (!document.location.pathname.startsWith('/play/s/')) {
+    return null;
+  }
+  return document.location.pathname.slice('/play/s/'.length).split('/')[0] || null;
+}
+
 class Schematic {
   constructor(simulator, root, state) {
     this.simulator = simulator;
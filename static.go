@@ -0,0 +1,274 @@
+package main
+
+// This file implements serving the frontend: only the files that are part of
+// the frontend are served, with cache validation, compression and security
+// headers.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache-Control header for static files with a version number in the name,
+// like resources/bootstrap-5.3.3.min.css. A new version has a different name.
+const staticImmutableCacheControl = "public, max-age=31536000, immutable"
+
+// Cache-Control header for all other static files. They can be cached, but
+// must be validated using the ETag before they are used.
+const staticRevalidateCacheControl = "public, no-cache"
+
+// Files smaller than this are not worth compressing.
+const staticCompressMinSize = 1024
+
+// File names with a version number, like jquery-3.3.1.slim.min.js.
+var staticFingerprinted = regexp.MustCompile(`-[0-9]+\.[0-9]+\.[0-9]+\.`)
+
+// Extensions of the files that are part of the frontend. Other files in the
+// served directory (Go source, Dockerfile, etc.) are not served.
+var staticExtensions = map[string]bool{
+	".html":  true,
+	".css":   true,
+	".js":    true,
+	".json":  true,
+	".txt":   true, // example programs
+	".svg":   true,
+	".png":   true,
+	".ico":   true,
+	".wasm":  true,
+	".woff2": true,
+}
+
+// Extensions of files that are already compressed.
+var staticCompressed = map[string]bool{
+	".png":   true,
+	".woff2": true,
+}
+
+// Files and directories in the root of the served directory that are not part
+// of the frontend, even though they have an extension listed above.
+var staticExcluded = map[string]bool{
+	"editor":            true, // sources of resources/editor.bundle.min.js
+	"embedded":          true,
+	"node_modules":      true,
+	"tinygo-template":   true,
+	"package.json":      true,
+	"package-lock.json": true,
+}
+
+// staticHandler serves the files of the frontend.
+type staticHandler struct {
+	fsys fs.FS
+
+	lock  sync.Mutex
+	files map[string]*staticFile // by path
+}
+
+// staticFile is a file read by staticHandler, with its compressed variants.
+type staticFile struct {
+	modTime time.Time
+	size    int64
+	data    []byte
+	etag    string                     // hash of the data, without quotes
+	encoded map[string]*staticEncoding // compressed variants by artifactEncoding suffix, guarded by staticHandler.lock
+}
+
+// staticEncoding is a compressed variant of a staticFile. It is created by the
+// first request that needs it, other requests wait until it is done.
+type staticEncoding struct {
+	done chan struct{} // closed when data and err are set
+	data []byte
+	err  error
+}
+
+func newStaticHandler(fsys fs.FS) *staticHandler {
+	return &staticHandler{
+		fsys:  fsys,
+		files: make(map[string]*staticFile),
+	}
+}
+
+// staticAllowed returns whether the file at the given path (relative to the
+// served directory) is part of the frontend.
+func staticAllowed(name string) bool {
+	parts := strings.Split(name, "/")
+	for _, part := range parts {
+		if strings.HasPrefix(part, ".") {
+			return false // dotfiles, like .git
+		}
+	}
+	if staticExcluded[parts[0]] {
+		return false
+	}
+	return staticExtensions[path.Ext(name)]
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Add headers that enable greater accuracy of performance.now() in
+	// Firefox.
+	w.Header().Set("Cross-Origin-Opener-Policy", "same-origin")
+	w.Header().Set("Cross-Origin-Embedder-Policy", "require-corp")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if conf.ReferrerPolicy != "" {
+		w.Header().Set("Referrer-Policy", conf.ReferrerPolicy)
+	}
+	if csp := conf.contentSecurityPolicy(); csp != "" {
+		w.Header().Set("Content-Security-Policy", csp)
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+	if !staticAllowed(name) {
+		// Maybe it's a directory, like /stats.
+		if st, err := fs.Stat(h.fsys, path.Join(name, "index.html")); err == nil && !st.IsDir() && staticAllowed(path.Join(name, "index.html")) {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := h.open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("could not read static file", "path", name, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if staticFingerprinted.MatchString(path.Base(name)) {
+		w.Header().Set("Cache-Control", staticImmutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", staticRevalidateCacheControl)
+	}
+
+	// Send a compressed variant if the client accepts it.
+	data := file.data
+	etag := file.etag
+	if file.size >= staticCompressMinSize && !staticCompressed[path.Ext(name)] {
+		w.Header().Add("Vary", "Accept-Encoding")
+		enc := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if enc.Name != "" {
+			encoded, err := h.encode(name, file, enc)
+			if err != nil {
+				logger(r.Context()).Error("could not compress static file", "path", name, "err", err)
+			} else {
+				data = encoded
+				etag += enc.Suffix
+				w.Header().Set("Content-Encoding", enc.Name)
+			}
+		}
+	}
+
+	// ServeContent handles If-None-Match using the ETag header.
+	w.Header().Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, r, name, file.modTime, bytes.NewReader(data))
+}
+
+// open reads the file at the given path, or returns it from the cache if it
+// hasn't changed.
+func (h *staticHandler) open(name string) (*staticFile, error) {
+	f, err := h.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.IsDir() {
+		return nil, fs.ErrNotExist
+	}
+
+	h.lock.Lock()
+	file := h.files[name]
+	h.lock.Unlock()
+	if file != nil && file.modTime.Equal(st.ModTime()) && file.size == st.Size() {
+		return file, nil
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	file = &staticFile{
+		modTime: st.ModTime(),
+		size:    st.Size(),
+		data:    data,
+		etag:    hex.EncodeToString(hash[:12]),
+		encoded: make(map[string]*staticEncoding),
+	}
+	h.lock.Lock()
+	h.files[name] = file
+	h.lock.Unlock()
+	return file, nil
+}
+
+// encode returns the file compressed with the given encoding. A precompressed
+// variant next to the file (like editor.bundle.min.js.br) is used if there is
+// one, otherwise the file is compressed once and kept in memory.
+func (h *staticHandler) encode(name string, file *staticFile, enc artifactEncoding) ([]byte, error) {
+	h.lock.Lock()
+	e, ok := file.encoded[enc.Suffix]
+	if !ok {
+		e = &staticEncoding{done: make(chan struct{})}
+		file.encoded[enc.Suffix] = e
+	}
+	h.lock.Unlock()
+	if ok {
+		<-e.done
+		return e.data, e.err
+	}
+
+	// Compress without holding the lock, so that other files can be served
+	// in the meantime.
+	e.data, e.err = h.readEncoded(name, file, enc)
+	if e.err != nil {
+		// Try again on the next request.
+		h.lock.Lock()
+		delete(file.encoded, enc.Suffix)
+		h.lock.Unlock()
+	}
+	close(e.done)
+	return e.data, e.err
+}
+
+// readEncoded reads the precompressed variant of the file, or compresses the
+// file if there is none.
+func (h *staticHandler) readEncoded(name string, file *staticFile, enc artifactEncoding) ([]byte, error) {
+	data, err := fs.ReadFile(h.fsys, name+enc.Suffix)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return data, err
+	}
+	buf := &bytes.Buffer{}
+	cw := enc.Compress(buf)
+	if _, err := cw.Write(file.data); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestStaticHandlerEncode(t *testing.T) {
+	content := strings.Repeat("console.log('hello');\n", 100)
+	h := newStaticHandler(fstest.MapFS{
+		"a.js": {Data: []byte(content)},
+		"b.js": {Data: []byte(content)},
+	})
+
+	// Concurrent requests for the same files all get the compressed data.
+	var wg sync.WaitGroup
+	bodies := make([][]byte, 8)
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/"+[]string{"a.js", "b.js"}[i%2], nil)
+			r.Header.Set("Accept-Encoding", "br")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != 200 || w.Header().Get("Content-Encoding") != "br" {
+				t.Errorf("request %d: status %d, encoding %q", i, w.Code, w.Header().Get("Content-Encoding"))
+			}
+			bodies[i] = w.Body.Bytes()
+		}()
+	}
+	wg.Wait()
+	for i, body := range bodies {
+		data, err := io.ReadAll(brotli.NewReader(bytes.NewReader(body)))
+		if err != nil || string(data) != content {
+			t.Errorf("request %d: could not decompress response: %v", i, err)
+		}
+	}
+	for _, name := range []string{"a.js", "b.js"} {
+		if e := h.files[name].encoded[".br"]; e == nil || e.err != nil {
+			t.Errorf("%s: compressed variant not kept: %+v", name, e)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+// This file implements the /api/stats endpoint, which aggregates the tracked
+// compile actions per day for the stats page.
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default and maximum number of days returned by /api/stats.
+const (
+	statsDefaultDays = 30
+	statsMaxDays     = 366
+)
+
+// Maximum number of days kept in the stats cache.
+const statsCacheDays = 2 * statsMaxDays
+
+// Dimensions that stats can be grouped by, in addition to the day.
+var statsDimensions = []string{"target", "compiler", "page", "flashFirmware", "outcome", "queueBucket", "buildBucket", "cacheTier", "toolchainVersion", "errorClass"}
+
+// Query parameters of /api/stats. Requests without any of them get the
+// response of the original endpoint, see writeLegacyJSON.
+var statsParams = []string{"from", "to", "groupBy", "format"}
+
+// Dimensions of the original endpoint, which returned the stored documents.
+var statsLegacyGroupBy = []string{"target", "compiler", "page", "flashFirmware"}
+
+// trackPoint is the number of compile actions on a single day with the same
+// properties, as returned by analyticsSink.Query.
+type trackPoint struct {
+	Day           time.Time
+	Page          string
+	Compiler      string
+	Target        string
+	FlashFirmware bool
+
+	// Details of the compile, see compileEvent. These are empty for compiles
+	// tracked before they were added.
+	Outcome          string
+	QueueBucket      string
+	BuildBucket      string
+	CacheTier        string
+	ToolchainVersion string
+	ErrorClass       string
+
+	Initial  int64 // unmodified code, like when a page is loaded
+	Modified int64 // code modified by the user
+}
+
+// dimension returns the value of the given dimension (one of
+// statsDimensions).
+func (p *trackPoint) dimension(name string) string {
+	switch name {
+	case "target":
+		return p.Target
+	case "compiler":
+		return p.Compiler
+	case "page":
+		return p.Page
+	case "flashFirmware":
+		return strconv.FormatBool(p.FlashFirmware)
+	case "outcome":
+		return p.Outcome
+	case "queueBucket":
+		return p.QueueBucket
+	case "buildBucket":
+		return p.BuildBucket
+	case "cacheTier":
+		return p.CacheTier
+	case "toolchainVersion":
+		return p.ToolchainVersion
+	case "errorClass":
+		return p.ErrorClass
+	default:
+		panic("unknown dimension: " + name)
+	}
+}
+
+// statsQuery is a parsed query to /api/stats.
+type statsQuery struct {
+	From    time.Time // first day, inclusive
+	To      time.Time // last day, inclusive
+	GroupBy []string
+}
+
+// statsRow is a single row in the aggregated stats.
+type statsRow struct {
+	Day      string   // formatted as YYYY-MM-DD
+	Group    []string // values of the statsQuery.GroupBy dimensions
+	Initial  int64
+	Modified int64
+}
+
+// statsResult is the result of a stats query.
+type statsResult struct {
+	Query statsQuery
+	Rows  []statsRow
+}
+
+// statsCache holds the points of each day that was queried. Queries are
+// answered from these points, so all date ranges and groupings share the
+// cache and can't be used to get around it.
+var statsCache = struct {
+	fetch sync.Mutex // held while querying the analytics sink
+	lock  sync.Mutex
+	days  map[string]*statsCacheDay // by day, formatted as YYYY-MM-DD
+}{
+	days: make(map[string]*statsCacheDay),
+}
+
+type statsCacheDay struct {
+	points  []trackPoint
+	expires time.Time
+}
+
+// handleStats handles the /api/stats endpoint. It returns the number of
+// compile actions per day, optionally grouped by more dimensions.
+//
+// Query parameters:
+//
+//	from      first day (YYYY-MM-DD), defaults to 30 days ago
+//	to        last day (YYYY-MM-DD), defaults to yesterday
+//	groupBy   comma-separated list of statsDimensions
+//	format    json (default) or csv
+//
+// Without any of these parameters, it returns the stats of the past 30 days in
+// the format of the original endpoint, for existing clients.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	// Allow access from everywhere.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	query, err := parseStatsQuery(r, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		format = "json"
+	case "json", "csv":
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("unrecognized format"))
+		return
+	}
+	if !slices.ContainsFunc(statsParams, r.Form.Has) {
+		format = "legacy"
+		query.GroupBy = statsLegacyGroupBy
+	}
+
+	result, err := getStats(r, query)
+	if err == errStatsUnavailable {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("stats are not available on this server"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not fetch stats data"))
+		logger(r.Context()).Error("could not fetch stats data", "err", err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(time.Duration(conf.StatsCacheTTL).Seconds())))
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="stats.csv"`)
+		result.writeCSV(w)
+	case "legacy":
+		w.Header().Set("Content-Type", "application/json")
+		result.writeLegacyJSON(w)
+	}
+}
+
+// parseStatsQuery parses the query parameters of a /api/stats request.
+func parseStatsQuery(r *http.Request, now time.Time) (statsQuery, error) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	query := statsQuery{
+		From: today.AddDate(0, 0, -statsDefaultDays),
+		To:   today.AddDate(0, 0, -1),
+	}
+	for _, param := range []struct {
+		name string
+		day  *time.Time
+	}{{"from", &query.From}, {"to", &query.To}} {
+		value := r.FormValue(param.name)
+		if value == "" {
+			continue
+		}
+		day, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return query, fmt.Errorf("invalid %s date %q, expected YYYY-MM-DD", param.name, value)
+		}
+		*param.day = day
+	}
+	if query.To.Before(query.From) {
+		return query, fmt.Errorf("from date is after to date")
+	}
+	if query.To.Sub(query.From) >= statsMaxDays*24*time.Hour {
+		return query, fmt.Errorf("date range is longer than %d days", statsMaxDays)
+	}
+
+	// Keep the dimensions in a fixed order, so that equivalent queries give
+	// the same result.
+	if groupBy := r.FormValue("groupBy"); groupBy != "" {
+		for _, name := range strings.Split(groupBy, ",") {
+			if !slices.Contains(statsDimensions, name) {
+				return query, fmt.Errorf("cannot group by %q", name)
+			}
+		}
+		for _, name := range statsDimensions {
+			if slices.Contains(strings.Split(groupBy, ","), name) {
+				query.GroupBy = append(query.GroupBy, name)
+			}
+		}
+	}
+	return query, nil
+}
+
+// getStats returns the aggregated stats for the query.
+func getStats(r *http.Request, query statsQuery) (*statsResult, error) {
+	points, err := getStatsPoints(r.Context(), query.From, query.To)
+	if err != nil {
+		return nil, err
+	}
+	return aggregateStats(query, points), nil
+}
+
+// getStatsPoints returns the points of all days from from to to (inclusive).
+// Only the days that aren't cached are queried from the analytics sink, one
+// query at a time, so that concurrent requests for the same days don't all
+// reach the sink.
+func getStatsPoints(ctx context.Context, from, to time.Time) ([]trackPoint, error) {
+	points, first, last := cachedStatsPoints(from, to, time.Now())
+	if first.IsZero() {
+		return points, nil
+	}
+	statsCache.fetch.Lock()
+	defer statsCache.fetch.Unlock()
+	// Another request may have fetched the same days in the meantime.
+	points, first, last = cachedStatsPoints(from, to, time.Now())
+	if first.IsZero() {
+		return points, nil
+	}
+
+	fetched, err := analytics.sink.Query(ctx, first, last.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	if ttl := time.Duration(conf.StatsCacheTTL); ttl > 0 {
+		now := time.Now()
+		statsCache.lock.Lock()
+		// Remove expired days. If the cache is still full, just start over:
+		// it is only there to avoid repeating the same query.
+		for day, entry := range statsCache.days {
+			if !now.Before(entry.expires) {
+				delete(statsCache.days, day)
+			}
+		}
+		if len(statsCache.days) >= statsCacheDays {
+			clear(statsCache.days)
+		}
+		for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+			statsCache.days[day.Format(time.DateOnly)] = &statsCacheDay{expires: now.Add(ttl)}
+		}
+		for _, point := range fetched {
+			if entry := statsCache.days[point.Day.UTC().Format(time.DateOnly)]; entry != nil {
+				entry.points = append(entry.points, point)
+			}
+		}
+		statsCache.lock.Unlock()
+	}
+
+	// The cached days in between were fetched again, so leave them out.
+	points = slices.DeleteFunc(points, func(point trackPoint) bool {
+		day := point.Day.UTC().Truncate(24 * time.Hour)
+		return !day.Before(first) && !day.After(last)
+	})
+	return append(points, fetched...), nil
+}
+
+// cachedStatsPoints returns the cached points of the days from from to to
+// (inclusive), and the first and last day in that range that isn't cached.
+// The first day is zero if all days are cached.
+func cachedStatsPoints(from, to, now time.Time) (points []trackPoint, first, last time.Time) {
+	statsCache.lock.Lock()
+	defer statsCache.lock.Unlock()
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		entry := statsCache.days[day.Format(time.DateOnly)]
+		if entry == nil || !now.Before(entry.expires) {
+			if first.IsZero() {
+				first = day
+			}
+			last = day
+			continue
+		}
+		points = append(points, entry.points...)
+	}
+	return points, first, last
+}
+
+// aggregateStats sums the tracked compile actions per day and per group.
+func aggregateStats(query statsQuery, points []trackPoint) *statsResult {
+	rows := make(map[string]*statsRow)
+	for _, point := range points {
+		row := statsRow{Day: point.Day.UTC().Format(time.DateOnly)}
+		for _, name := range query.GroupBy {
+			row.Group = append(row.Group, point.dimension(name))
+		}
+		key := row.Day + "\x00" + strings.Join(row.Group, "\x00")
+		if rows[key] == nil {
+			rows[key] = &row
+		}
+		rows[key].Initial += point.Initial
+		rows[key].Modified += point.Modified
+	}
+
+	result := &statsResult{Query: query, Rows: []statsRow{}}
+	for _, row := range rows {
+		result.Rows = append(result.Rows, *row)
+	}
+	sort.Slice(result.Rows, func(i, j int) bool {
+		a, b := result.Rows[i], result.Rows[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		return slices.Compare(a.Group, b.Group) < 0
+	})
+	return result
+}
+
+func (result *statsResult) MarshalJSON() ([]byte, error) {
+	rows := []map[string]any{}
+	for _, row := range result.Rows {
+		obj := map[string]any{
+			"day":      row.Day,
+			"initial":  row.Initial,
+			"modified": row.Modified,
+		}
+		for i, name := range result.Query.GroupBy {
+			obj[name] = row.Group[i]
+		}
+		rows = append(rows, obj)
+	}
+	groupBy := result.Query.GroupBy
+	if groupBy == nil {
+		groupBy = []string{}
+	}
+	return json.Marshal(map[string]any{
+		"from":    result.Query.From.Format(time.DateOnly),
+		"to":      result.Query.To.Format(time.DateOnly),
+		"groupBy": groupBy,
+		"rows":    rows,
+	})
+}
+
+// writeLegacyJSON writes the result in the format of the original endpoint: an
+// array of objects with the fields of the documents in Firestore. The result
+// must be grouped by statsLegacyGroupBy.
+func (result *statsResult) writeLegacyJSON(w io.Writer) error {
+	docs := []map[string]any{}
+	for _, row := range result.Rows {
+		day, _ := time.Parse(time.DateOnly, row.Day)
+		doc := map[string]any{
+			"timestamp":      day,
+			"count_initial":  row.Initial,
+			"count_modified": row.Modified,
+		}
+		for i, name := range result.Query.GroupBy {
+			doc[name] = row.Group[i]
+		}
+		doc["flashFirmware"] = doc["flashFirmware"] == "true"
+		docs = append(docs, doc)
+	}
+	return json.NewEncoder(w).Encode(docs)
+}
+
+// writeCSV writes the result as CSV, with a header row.
+func (result *statsResult) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := append([]string{"day"}, result.Query.GroupBy...)
+	header = append(header, "initial", "modified")
+	cw.Write(header)
+	for _, row := range result.Rows {
+		record := append([]string{row.Day}, row.Group...)
+		record = append(record, strconv.FormatInt(row.Initial, 10), strconv.FormatInt(row.Modified, 10))
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -16,8 +16,8 @@ function updatePageList() {
     let modifiedPageCount = {};
     for (let point of data) {
         selectedPages.add(point.page);
-        initialPageCount[point.page] = (initialPageCount[point.page]||0) + point.count_initial;
-        modifiedPageCount[point.page] = (modifiedPageCount[point.page]||0) + point.count_modified;
+        initialPageCount[point.page] = (initialPageCount[point.page]||0) + point.initial;
+        modifiedPageCount[point.page] = (modifiedPageCount[point.page]||0) + point.modified;
     }
     let pages = Array.from(selectedPages);
     pages.sort();
@@ -145,9 +145,9 @@ async function createCharts() {
         }
     });
 
-    // Fetch the data from the API.
-    let req = await fetch(`${API_URL}/stats`);
-    data = await req.json();
+    // Fetch the data from the API, aggregated per day, page and target.
+    let req = await fetch(`${API_URL}/stats?groupBy=page,target,compiler`);
+    data = (await req.json()).rows;
 
     // Now that we have the data, update all charts and such.
     updatePageList();
@@ -171,7 +171,7 @@ function updateCharts() {
     let targetValues = {};
     for (let point of data) {
         // Skip entries out of the date range or with invalid data.
-        let day = Math.floor((new Date(point.timestamp)).getTime() / 1000 / 86400);
+        let day = Math.floor((new Date(point.day)).getTime() / 1000 / 86400);
         let index = numDays - (currentDay - day);
         if (index < 0 || index >= numDays || !point.target) {
             continue;
@@ -187,8 +187,8 @@ function updateCharts() {
 
         // Count the maximum value of each chart, separate from whether some
         // pages are skipped. This keeps the chart at a consistent height.
-        monthValues[index] = (monthValues[index]||0) + point.count_initial + point.count_modified;
-        targetValues[target] = (targetValues[target]||0) + point.count_initial + point.count_modified;
+        monthValues[index] = (monthValues[index]||0) + point.initial + point.modified;
+        targetValues[target] = (targetValues[target]||0) + point.initial + point.modified;
 
         // Don't count pages that are being skipped.
         if (!selectedPages.has(point.page)) {
@@ -196,10 +196,10 @@ function updateCharts() {
         }
 
         // Count stats.
-        dataMonthInitial[index] += point.count_initial;
-        dataMonthModified[index] += point.count_modified;
-        dataTargetsInitial[target] = (dataTargetsInitial[target]||0) + point.count_initial;
-        dataTargetsModified[target] = (dataTargetsModified[target]||0) + point.count_modified;
+        dataMonthInitial[index] += point.initial;
+        dataMonthModified[index] += point.modified;
+        dataTargetsInitial[target] = (dataTargetsInitial[target]||0) + point.initial;
+        dataTargetsModified[target] = (dataTargetsModified[target]||0) + point.modified;
     }
 
     // Update the time chart with the new data.
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingAnalytics is a memoryAnalytics that records the queried ranges.
+type countingAnalytics struct {
+	memoryAnalytics
+	queries []string
+}
+
+func (c *countingAnalytics) Query(ctx context.Context, from, to time.Time) ([]trackPoint, error) {
+	c.queries = append(c.queries, from.Format(time.DateOnly)+"/"+to.Format(time.DateOnly))
+	return c.memoryAnalytics.Query(ctx, from, to)
+}
+
+// useStatsSink replaces the analytics sink with one that has the given events
+// and empties the stats cache for the duration of the test.
+func useStatsSink(t *testing.T, events ...compileEvent) *countingAnalytics {
+	t.Helper()
+	sink := &countingAnalytics{}
+	sink.events = events
+	oldAnalytics, oldConf := analytics, conf
+	analytics = &analyticsQueue{sink: sink}
+	conf.StatsCacheTTL = duration(time.Minute)
+	clear(statsCache.days)
+	t.Cleanup(func() {
+		analytics, conf = oldAnalytics, oldConf
+		clear(statsCache.days)
+	})
+	return sink
+}
+
+func TestParseStatsQuery(t *testing.T) {
+	now := time.Date(2024, 6, 15, 13, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		query    string
+		from, to string
+		groupBy  []string
+		err      string
+	}{
+		{"", "2024-05-16", "2024-06-14", nil, ""},
+		{"from=2024-06-01&to=2024-06-01", "2024-06-01", "2024-06-01", nil, ""},
+		{"from=2023-06-16&to=2024-06-15", "2023-06-16", "2024-06-15", nil, ""},
+		{"groupBy=outcome,target,outcome", "2024-05-16", "2024-06-14", []string{"target", "outcome"}, ""},
+		{"from=2024-6-1", "", "", nil, `invalid from date "2024-6-1"`},
+		{"to=yesterday", "", "", nil, `invalid to date "yesterday"`},
+		{"from=2024-06-02&to=2024-06-01", "", "", nil, "from date is after to date"},
+		{"from=2023-06-15&to=2024-06-15", "", "", nil, "longer than 366 days"},
+		{"groupBy=target,ip", "", "", nil, `cannot group by "ip"`},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			query, err := parseStatsQuery(httptest.NewRequest("GET", "/api/stats?"+tc.query, nil), now)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("got error %v, expected %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from := query.From.Format(time.DateOnly); from != tc.from {
+				t.Errorf("from is %s, expected %s", from, tc.from)
+			}
+			if to := query.To.Format(time.DateOnly); to != tc.to {
+				t.Errorf("to is %s, expected %s", to, tc.to)
+			}
+			if !slices.Equal(query.GroupBy, tc.groupBy) {
+				t.Errorf("groupBy is %q, expected %q", query.GroupBy, tc.groupBy)
+			}
+		})
+	}
+}
+
+func TestAggregateStats(t *testing.T) {
+	day1 := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	points := []trackPoint{
+		{Day: day2, Target: "wasm", Outcome: "success", Initial: 1},
+		{Day: day1, Target: "wasm", Outcome: "success", Initial: 2, Modified: 1},
+		{Day: day1, Target: "arduino", Outcome: "success", Modified: 4},
+		{Day: day1, Target: "wasm", Outcome: "compile-error", Modified: 3},
+	}
+	query := statsQuery{From: day1, To: day2, GroupBy: []string{"target"}}
+	result := aggregateStats(query, points)
+	want := []statsRow{
+		{"2024-06-01", []string{"arduino"}, 0, 4},
+		{"2024-06-01", []string{"wasm"}, 2, 4},
+		{"2024-06-02", []string{"wasm"}, 1, 0},
+	}
+	if !slices.EqualFunc(result.Rows, want, func(a, b statsRow) bool {
+		return a.Day == b.Day && slices.Equal(a.Group, b.Group) && a.Initial == b.Initial && a.Modified == b.Modified
+	}) {
+		t.Errorf("got rows %+v, expected %+v", result.Rows, want)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON := `{"from":"2024-06-01","groupBy":["target"],"rows":[` +
+		`{"day":"2024-06-01","initial":0,"modified":4,"target":"arduino"},` +
+		`{"day":"2024-06-01","initial":2,"modified":4,"target":"wasm"},` +
+		`{"day":"2024-06-02","initial":1,"modified":0,"target":"wasm"}],"to":"2024-06-02"}`
+	if string(data) != wantJSON {
+		t.Errorf("got JSON %s, expected %s", data, wantJSON)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := result.writeCSV(buf); err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "day,target,initial,modified\n" +
+		"2024-06-01,arduino,0,4\n" +
+		"2024-06-01,wasm,2,4\n" +
+		"2024-06-02,wasm,1,0\n"
+	if buf.String() != wantCSV {
+		t.Errorf("got CSV:\n%s\nexpected:\n%s", buf, wantCSV)
+	}
+
+	// Without grouping, all points of a day are summed.
+	result = aggregateStats(statsQuery{From: day1, To: day2}, points)
+	if len(result.Rows) != 2 || result.Rows[0].Initial != 2 || result.Rows[0].Modified != 8 {
+		t.Errorf("ungrouped rows: %+v", result.Rows)
+	}
+}
+
+func TestHandleStatsLegacy(t *testing.T) {
+	yesterday := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	useStatsSink(t,
+		compileEvent{Time: yesterday.Add(time.Hour), Page: "playground", Compiler: "tinygo", Target: "arduino", FlashFirmware: true, Outcome: "success"},
+		compileEvent{Time: yesterday.Add(2 * time.Hour), Page: "playground", Compiler: "tinygo", Target: "arduino", FlashFirmware: true, Outcome: "timeout", Modified: true},
+	)
+	w := httptest.NewRecorder()
+	handleStats(w, httptest.NewRequest("GET", "/api/stats", nil))
+	var docs []map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &docs); err != nil {
+		t.Fatalf("response is not an array: %v: %s", err, w.Body)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("got %d documents, expected the events summed into 1: %s", len(docs), w.Body)
+	}
+	want := map[string]any{
+		"timestamp":      yesterday.Format(time.RFC3339),
+		"page":           "playground",
+		"compiler":       "tinygo",
+		"target":         "arduino",
+		"flashFirmware":  true,
+		"count_initial":  1.0,
+		"count_modified": 1.0,
+	}
+	for key, value := range want {
+		if docs[0][key] != value {
+			t.Errorf("%s is %v, expected %v", key, docs[0][key], value)
+		}
+	}
+	if len(docs[0]) != len(want) {
+		t.Errorf("unexpected fields in %v", docs[0])
+	}
+
+	// Any of the new parameters selects the new format.
+	w = httptest.NewRecorder()
+	handleStats(w, httptest.NewRequest("GET", "/api/stats?groupBy=outcome", nil))
+	var result map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result["rows"] == nil {
+		t.Errorf("expected an object with rows, got %s", w.Body)
+	}
+}
+
+func TestStatsCache(t *testing.T) {
+	ctx := context.Background()
+	day := func(d int) time.Time { return time.Date(2024, 6, d, 0, 0, 0, 0, time.UTC) }
+	sink := useStatsSink(t,
+		compileEvent{Time: day(1).Add(time.Hour), Target: "wasm"},
+		compileEvent{Time: day(3).Add(time.Hour), Target: "wasm"},
+		compileEvent{Time: day(5).Add(time.Hour), Target: "wasm"},
+	)
+	for _, tc := range []struct {
+		from, to int
+		points   int
+		queries  []string // new queries to the sink
+	}{
+		{2, 4, 1, []string{"2024-06-02/2024-06-05"}},
+		{3, 3, 1, nil}, // cached
+		{2, 4, 1, nil}, // cached, in any grouping
+		{1, 5, 3, []string{"2024-06-01/2024-06-06"}},
+		{1, 5, 3, nil},
+	} {
+		before := len(sink.queries)
+		points, err := getStatsPoints(ctx, day(tc.from), day(tc.to))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != tc.points {
+			t.Errorf("June %d-%d: got %d points, expected %d", tc.from, tc.to, len(points), tc.points)
+		}
+		if queries := sink.queries[before:]; !slices.Equal(queries, tc.queries) {
+			t.Errorf("June %d-%d: queried %q, expected %q", tc.from, tc.to, queries, tc.queries)
+		}
+	}
+
+	// Expired days are queried again.
+	for _, entry := range statsCache.days {
+		entry.expires = time.Now()
+	}
+	before := len(sink.queries)
+	if _, err := getStatsPoints(ctx, day(3), day(3)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.queries) != before+1 {
+		t.Errorf("expired day was not queried again")
+	}
+}
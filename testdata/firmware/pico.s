@@ -0,0 +1,16 @@
+	.section .boot2, "ax"
+	.fill 252, 1, 0xb2
+	.section .isr_vector, "a"
+	.long 0x20000800, 0x10000111, 0x10000121, 0x10000131
+	.text
+	.globl Reset_Handler
+Reset_Handler:
+	.fill 600, 1, 0x5a
+	.section .rodata, "a"
+	.ascii "hello, pico\0"
+	.byte 1, 2, 3
+	.data
+	.long 0xdeadbeef, 0xcafef00d
+	.byte 9
+	.bss
+	.space 64
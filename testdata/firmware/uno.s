@@ -0,0 +1,13 @@
+	.section .vectors, "ax"
+	.fill 26, 4, 0x0c94
+	.section .text.main, "ax"
+	.globl main
+main:
+	.fill 201, 1, 0x7e
+	.section .rodata, "a"
+	.ascii "hello, uno\0"
+	.data
+	.short 0x1234
+	.byte 5
+	.bss
+	.space 16
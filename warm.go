@@ -0,0 +1,171 @@
+package main
+
+// This file implements the "warm" subcommand, which compiles the example of
+// every board in the menu of the frontend (see examples/boards.json) to fill
+// the toolchain cache and the artifact cache before the server starts taking
+// traffic. The examples are compiled exactly as the frontend sends them, so
+// that the artifacts are found in the cache.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// example is the example program of a board in the menu of the frontend.
+type example struct {
+	Name     string // name of the menu entry in examples/boards.json
+	Board    string // name of the board (see parts/*.json)
+	Compiler string
+	Source   []byte // source code as sent by the browser
+}
+
+// exampleMenuEntry is a single entry in examples/boards.json, the boards in
+// the menu of the frontend.
+type exampleMenuEntry struct {
+	Name      string `json:"name"`
+	HumanName string `json:"humanName"`
+	Location  string `json:"location"` // board definition, like parts/pico.json
+	Compiler  string `json:"compiler"`
+	Example   string `json:"example"` // file in the examples directory
+}
+
+// warmCache runs the "warm" subcommand.
+func warmCache(args []string) {
+	flags := flag.NewFlagSet("warm", flag.ExitOnError)
+	partsDir := flags.String("parts", "", "directory with board definitions (default: the parts of the frontend)")
+	flags.Parse(args)
+
+	var partsFS fs.FS
+	var err error
+	if *partsDir != "" {
+		partsFS = os.DirFS(*partsDir)
+	} else {
+		partsFS, err = fs.Sub(frontendFS(), "parts")
+		if err != nil {
+			fatal("could not read boards", "err", err)
+		}
+	}
+	boards, err := readBoards(partsFS)
+	if err != nil {
+		fatal("could not read boards", "err", err)
+	}
+	examples, err := readExamples(frontendFS())
+	if err != nil {
+		fatal("could not read examples", "err", err)
+	}
+
+	failed := 0
+	for _, ex := range examples {
+		i := sort.Search(len(boards), func(i int) bool {
+			return boards[i].Name >= ex.Board
+		})
+		if i == len(boards) || boards[i].Name != ex.Board {
+			slog.Error("example for unknown board", "example", ex.Name, "board", ex.Board)
+			failed++
+			continue
+		}
+		board := boards[i]
+		for _, format := range warmFormats(board, ex.Compiler) {
+			start := time.Now()
+			err := compileSource(context.Background(), ex.Source, ex.Compiler, board, format)
+			if err != nil {
+				slog.Error("failed to compile example", "example", ex.Name, "board", board.Name, "compiler", ex.Compiler, "format", format, "err", err)
+				failed++
+				continue
+			}
+			slog.Info("compiled example", "example", ex.Name, "board", board.Name, "compiler", ex.Compiler, "format", format, "duration", time.Since(start))
+		}
+	}
+	if failed != 0 {
+		fatal("some compile jobs failed", "failed", failed)
+	}
+}
+
+// warmFormats returns the formats to compile an example to: for the
+// simulator, and for flashing to the board in every format the board supports.
+func warmFormats(board *partDefinition, compiler string) []string {
+	formats := []string{"wasi"}
+	if compiler == "tinygo" {
+		formats = append(formats, board.supportedFirmwareFormats()...)
+	}
+	return formats
+}
+
+// readBoards reads all board definitions (parts with a main part) from the
+// given directory, sorted by name.
+func readBoards(fsys fs.FS) ([]*partDefinition, error) {
+	paths, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+	var boards []*partDefinition
+	for _, path := range paths {
+		if path == "parts.json" {
+			continue
+		}
+		board, err := readPartDefinition(fsys, path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if board.MainPart == "" {
+			continue // not a board (for example, parts.json)
+		}
+		boards = append(boards, board)
+	}
+	sort.Slice(boards, func(i, j int) bool {
+		return boards[i].Name < boards[j].Name
+	})
+	return boards, nil
+}
+
+// readExamples reads the example of every board in the menu from
+// examples/boards.json in the given frontend, in the order of the menu.
+func readExamples(fsys fs.FS) ([]example, error) {
+	data, err := fs.ReadFile(fsys, "examples/boards.json")
+	if err != nil {
+		return nil, err
+	}
+	var entries []exampleMenuEntry
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&entries); err != nil {
+		return nil, fmt.Errorf("examples/boards.json: %w", err)
+	}
+	var examples []example
+	for _, entry := range entries {
+		board, ok := strings.CutPrefix(entry.Location, "parts/")
+		board, ok2 := strings.CutSuffix(board, ".json")
+		if entry.Name == "" || !ok || !ok2 || entry.Example == "" || !fs.ValidPath(entry.Example) {
+			return nil, fmt.Errorf("examples/boards.json: invalid entry %+v", entry)
+		}
+		if entry.Compiler != "go" && entry.Compiler != "tinygo" {
+			return nil, fmt.Errorf("examples/boards.json: %s: unknown compiler %q", entry.Name, entry.Compiler)
+		}
+		source, err := fs.ReadFile(fsys, path.Join("examples", entry.Example))
+		if err != nil {
+			return nil, fmt.Errorf("examples/boards.json: %s: %w", entry.Name, err)
+		}
+		examples = append(examples, example{
+			Name:     entry.Name,
+			Board:    board,
+			Compiler: entry.Compiler,
+			// The final newline of the file is not part of the code, see
+			// loadExample in boards.js.
+			Source: bytes.TrimSuffix(source, []byte("\n")),
+		})
+	}
+	if len(examples) == 0 {
+		return nil, fmt.Errorf("examples/boards.json: no boards found")
+	}
+	return examples, nil
+}
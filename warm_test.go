@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReadExamples(t *testing.T) {
+	examples, err := readExamples(os.DirFS("."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	boards, err := readBoards(os.DirFS("parts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(examples) < 2 || examples[0].Name != "console-go" || examples[0].Board != "console" || examples[0].Compiler != "go" {
+		t.Fatalf("unexpected first example: %+v", examples[0])
+	}
+	for _, ex := range examples {
+		if !slices.ContainsFunc(boards, func(board *partDefinition) bool { return board.Name == ex.Board }) {
+			t.Errorf("%s: unknown board %q", ex.Name, ex.Board)
+		}
+		if !bytes.HasPrefix(ex.Source, []byte("package main\n")) && !bytes.HasPrefix(ex.Source, []byte("//")) {
+			t.Errorf("%s: unexpected source: %.40q", ex.Name, ex.Source)
+		}
+		if bytes.HasSuffix(ex.Source, []byte("\n")) {
+			t.Errorf("%s: source ends in a newline, unlike the code the browser sends", ex.Name)
+		}
+	}
+}
+
+func TestReadExamplesErrors(t *testing.T) {
+	const pico = `{"name": "pico", "humanName": "Pico", "location": "parts/pico.json", "compiler": "tinygo", "example": "blinky.txt"}`
+	for _, tc := range []struct {
+		name, boardsJSON, err string
+	}{
+		{"valid", "[" + pico + "]", ""},
+		{"not JSON", "{", "unexpected EOF"},
+		{"unknown field", `[{"name": "pico", "code": "package main"}]`, `unknown field "code"`},
+		{"invalid location", `[{"name": "pico", "location": "pico.json", "compiler": "tinygo", "example": "blinky.txt"}]`, "invalid entry"},
+		{"invalid example", `[{"name": "pico", "location": "parts/pico.json", "compiler": "tinygo", "example": "../main.go"}]`, "invalid entry"},
+		{"unknown compiler", `[{"name": "pico", "location": "parts/pico.json", "compiler": "gcc", "example": "blinky.txt"}]`, `unknown compiler "gcc"`},
+		{"unknown example", `[{"name": "pico", "location": "parts/pico.json", "compiler": "tinygo", "example": "hello.txt"}]`, "hello.txt"},
+		{"no boards", "[]", "no boards found"},
+		{"null", "null", "no boards found"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			examples, err := readExamples(fstest.MapFS{
+				"examples/boards.json": {Data: []byte(tc.boardsJSON)},
+				"examples/blinky.txt":  {Data: []byte("package main\n")},
+			})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("got error %v, expected %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := example{Name: "pico", Board: "pico", Compiler: "tinygo", Source: []byte("package main")}
+			if len(examples) != 1 || examples[0].Name != want.Name || examples[0].Board != want.Board ||
+				examples[0].Compiler != want.Compiler || !bytes.Equal(examples[0].Source, want.Source) {
+				t.Errorf("got %+v, expected %+v", examples, want)
+			}
+		})
+	}
+}
+
+func TestWarmFormats(t *testing.T) {
+	for _, tc := range []struct {
+		board    partDefinition
+		compiler string
+		formats  []string
+	}{
+		{partDefinition{Name: "console"}, "go", []string{"wasi"}},
+		{partDefinition{Name: "console"}, "tinygo", []string{"wasi"}},
+		{partDefinition{Name: "arduino", FirmwareFormat: "hex"}, "tinygo", []string{"wasi", "hex"}},
+		{partDefinition{Name: "pico", FirmwareFormat: "uf2", FirmwareFormats: []string{"uf2", "elf", "bin", "bundle"}}, "tinygo", []string{"wasi", "uf2", "elf", "bin", "bundle"}},
+		{partDefinition{Name: "pico", FirmwareFormat: "uf2", FirmwareFormats: []string{"uf2", "elf"}}, "go", []string{"wasi"}},
+	} {
+		if formats := warmFormats(&tc.board, tc.compiler); !slices.Equal(formats, tc.formats) {
+			t.Errorf("%s with %s: got %q, expected %q", tc.board.Name, tc.compiler, formats, tc.formats)
+		}
+	}
+}